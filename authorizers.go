@@ -0,0 +1,402 @@
+package rabbit
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Authorizer decide if user can access uri with method, used by WithAuthorization
+type Authorizer interface {
+	Authorize(db *gorm.DB, user *User, uri, method string) (bool, error)
+}
+
+// DefaultAuthorizer is used by WithAuthorization
+var DefaultAuthorizer Authorizer = GormAuthorizer{}
+
+// GormAuthorizer check by the Role/Permission tables, see CheckUserPermission
+type GormAuthorizer struct{}
+
+func (GormAuthorizer) Authorize(db *gorm.DB, user *User, uri, method string) (bool, error) {
+	return CheckUserPermission(db, user.ID, uri, method)
+}
+
+/*
+CasbinAuthorizer check by an in-process casbin style enforcer,
+the subject of user is UserSubject, e.g. "g, user:1, role:admin".
+The enforcer is a snapshot of the tables, the expiration of grants is checked by Enforce,
+other changes (revoked roles, deny rules, deleted permissions) are applied by LoadFromDB, see StartReloading
+*/
+type CasbinAuthorizer struct {
+	Enforcer *Enforcer
+}
+
+func NewCasbinAuthorizer(db *gorm.DB) (*CasbinAuthorizer, error) {
+	e := NewEnforcer()
+	if err := e.LoadFromDB(db); err != nil {
+		return nil, err
+	}
+	return &CasbinAuthorizer{Enforcer: e}, nil
+}
+
+func (a *CasbinAuthorizer) Authorize(db *gorm.DB, user *User, uri, method string) (bool, error) {
+	return a.Enforcer.Enforce(UserSubject(user.ID), uri, method), nil
+}
+
+// StartReloading run Enforcer.LoadFromDB every interval in background, until stop is called
+func (a *CasbinAuthorizer) StartReloading(db *gorm.DB, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := a.Enforcer.LoadFromDB(db); err != nil {
+					Warningln("reload enforcer fail:", err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// AnySubject is the subject of anonymous permissions
+const AnySubject = "*"
+
+// subjects are namespaced, so a role named "*", "2" or "group:x" never collides with others
+func UserSubject(uid uint) string {
+	return "user:" + strconv.Itoa(int(uid))
+}
+
+func RoleSubject(name string) string {
+	return "role:" + name
+}
+
+func GroupSubject(name string) string {
+	return "group:" + name
+}
+
+type EnforcerPolicy struct {
+	Subject string
+	Object  string
+	Action  string
+	Deny    bool
+}
+
+/*
+Enforcer is a casbin style enforcer, with policy lines:
+
+	p, role:admin, /user/:key, DELETE
+	p, role:support, /user/:key, DELETE, deny
+	p, *, /ping, GET
+	g, user:1, role:admin
+	g, user:2, role:oncall, 2023-06-01T00:00:00Z
+
+the grouping with RFC3339 time expires at that time, match order is the same as CheckUserPermission: deny > allow > default deny
+*/
+type Enforcer struct {
+	// ObjectMatcher match the request object with policy object, default is KeyMatch2
+	ObjectMatcher func(object, pattern string) bool
+
+	lock      sync.RWMutex
+	policies  []EnforcerPolicy
+	groupings map[string][]enforcerGrouping
+}
+
+type enforcerGrouping struct {
+	role      string
+	expiresAt time.Time // zero means never expires
+}
+
+func NewEnforcer() *Enforcer {
+	return &Enforcer{
+		ObjectMatcher: KeyMatch2,
+		groupings:     map[string][]enforcerGrouping{},
+	}
+}
+
+func (e *Enforcer) AddPolicy(subject, object, action string, deny bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.policies = append(e.policies, EnforcerPolicy{Subject: subject, Object: object, Action: action, Deny: deny})
+}
+
+// AddGrouping user or role inherits role
+func (e *Enforcer) AddGrouping(subject, role string) {
+	e.AddGroupingUntil(subject, role, time.Time{})
+}
+
+// AddGroupingUntil user or role inherits role until expiresAt, zero means never expires
+func (e *Enforcer) AddGroupingUntil(subject, role string, expiresAt time.Time) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.groupings[subject] = append(e.groupings[subject], enforcerGrouping{role: role, expiresAt: expiresAt})
+}
+
+func (e *Enforcer) Clear() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.policies = nil
+	e.groupings = map[string][]enforcerGrouping{}
+}
+
+// LoadPolicyText load "p, sub, obj, act[, deny]" and "g, sub, role[, expiresAt]" lines, # for comment
+func (e *Enforcer) LoadPolicyText(text string) error {
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		vals := strings.Split(line, ",")
+		for i := range vals {
+			vals[i] = strings.TrimSpace(vals[i])
+		}
+		switch {
+		case vals[0] == "p" && len(vals) == 4:
+			e.AddPolicy(vals[1], vals[2], vals[3], false)
+		case vals[0] == "p" && len(vals) == 5 && (vals[4] == "allow" || vals[4] == "deny"):
+			e.AddPolicy(vals[1], vals[2], vals[3], vals[4] == "deny")
+		case vals[0] == "g" && len(vals) == 3:
+			e.AddGrouping(vals[1], vals[2])
+		case vals[0] == "g" && len(vals) == 4:
+			expiresAt, err := time.Parse(time.RFC3339, vals[3])
+			if err != nil {
+				return fmt.Errorf("line %d: invalid expiration: %s", n, line)
+			}
+			e.AddGroupingUntil(vals[1], vals[2], expiresAt)
+		default:
+			return fmt.Errorf("line %d: invalid policy: %s", n, line)
+		}
+	}
+	return scanner.Err()
+}
+
+// PolicyText dump policies as lines, can be loaded by LoadPolicyText
+func (e *Enforcer) PolicyText() string {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	var b strings.Builder
+	for _, p := range e.policies {
+		if p.Deny {
+			fmt.Fprintf(&b, "p, %s, %s, %s, deny\n", p.Subject, p.Object, p.Action)
+		} else {
+			fmt.Fprintf(&b, "p, %s, %s, %s\n", p.Subject, p.Object, p.Action)
+		}
+	}
+
+	subjects := make([]string, 0, len(e.groupings))
+	for sub := range e.groupings {
+		subjects = append(subjects, sub)
+	}
+	sort.Strings(subjects)
+	for _, sub := range subjects {
+		for _, g := range e.groupings[sub] {
+			if g.expiresAt.IsZero() {
+				fmt.Fprintf(&b, "g, %s, %s\n", sub, g.role)
+			} else {
+				fmt.Fprintf(&b, "g, %s, %s, %s\n", sub, g.role, g.expiresAt.UTC().Format(time.RFC3339Nano))
+			}
+		}
+	}
+	return b.String()
+}
+
+/*
+LoadFromDB replace the policies by the tables
+1. role grants: p, role:name, uri, method[, deny]
+2. group grants: p, group:name, uri, method[, deny]
+3. anonymous permissions: p, *, uri, method
+4. user roles without expired: g, user:uid, role:name[, expiresAt], checked again by Enforce
+5. group members: g, user:uid, group:name
+*/
+func (e *Enforcer) LoadFromDB(db *gorm.DB) error {
+	type grant struct {
+		Subject string
+		Uri     string
+		Method  string
+		Deny    bool
+	}
+
+	// 1
+	var roleGrants []grant
+	result := db.Table("? AS role_permissions", tableOf(db, &RolePermission{})).
+		Select("roles.name as subject, permissions.uri, permissions.method, role_permissions.deny").
+		Joins("JOIN ? AS roles ON roles.id = role_permissions.role_id", tableOf(db, &Role{})).
+		Joins("JOIN ? AS permissions ON permissions.id = role_permissions.permission_id", tableOf(db, &Permission{})).
+		Order("roles.name, permissions.id").
+		Scan(&roleGrants)
+	if result.Error != nil {
+		return result.Error
+	}
+	for i := range roleGrants {
+		roleGrants[i].Subject = RoleSubject(roleGrants[i].Subject)
+	}
+
+	// 2
+	var groupGrants []grant
+	result = db.Table("? AS group_permissions", tableOf(db, &GroupPermission{})).
+		Select("g.name as subject, permissions.uri, permissions.method, group_permissions.deny").
+		Joins("JOIN ? AS g ON g.id = group_permissions.group_id", tableOf(db, &Group{})).
+		Joins("JOIN ? AS permissions ON permissions.id = group_permissions.permission_id", tableOf(db, &Permission{})).
+		Order("g.name, permissions.id").
+		Scan(&groupGrants)
+	if result.Error != nil {
+		return result.Error
+	}
+	for i := range groupGrants {
+		groupGrants[i].Subject = GroupSubject(groupGrants[i].Subject)
+	}
+
+	// 3
+	var anonymous []*Permission
+	if err := db.Where("anonymous", true).Order("id").Find(&anonymous).Error; err != nil {
+		return err
+	}
+
+	// 4
+	var userRoles []struct {
+		UserID    uint
+		Name      string
+		ExpiresAt *time.Time
+	}
+	result = db.Table("? AS user_roles", tableOf(db, &UserRole{})).
+		Select("user_roles.user_id, roles.name, user_roles.expires_at").
+		Joins("JOIN ? AS roles ON roles.id = user_roles.role_id", tableOf(db, &Role{})).
+		Where("user_roles.expires_at IS NULL OR user_roles.expires_at > ?", time.Now().UTC()).
+		Order("user_roles.user_id, roles.name").
+		Scan(&userRoles)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	// 5
+	var members []struct {
+		UserID uint
+		Name   string
+	}
+	result = db.Table("? AS group_members", tableOf(db, &GroupMember{})).
+		Select("group_members.user_id, g.name").
+		Joins("JOIN ? AS g ON g.id = group_members.group_id", tableOf(db, &Group{})).
+		Order("group_members.user_id, g.name").
+		Scan(&members)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	// swap at once, not visible to Enforce while loading
+	policies := make([]EnforcerPolicy, 0, len(roleGrants)+len(groupGrants)+len(anonymous))
+	for _, g := range append(roleGrants, groupGrants...) {
+		policies = append(policies, EnforcerPolicy{Subject: g.Subject, Object: g.Uri, Action: g.Method, Deny: g.Deny})
+	}
+	for _, p := range anonymous {
+		policies = append(policies, EnforcerPolicy{Subject: AnySubject, Object: p.Uri, Action: p.Method})
+	}
+	groupings := map[string][]enforcerGrouping{}
+	for _, ur := range userRoles {
+		uid := UserSubject(ur.UserID)
+		g := enforcerGrouping{role: RoleSubject(ur.Name)}
+		if ur.ExpiresAt != nil {
+			g.expiresAt = *ur.ExpiresAt
+		}
+		groupings[uid] = append(groupings[uid], g)
+	}
+	for _, m := range members {
+		uid := UserSubject(m.UserID)
+		groupings[uid] = append(groupings[uid], enforcerGrouping{role: GroupSubject(m.Name)})
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.policies = policies
+	e.groupings = groupings
+	return nil
+}
+
+// Enforce check if subject can do action on object
+func (e *Enforcer) Enforce(subject, object, action string) bool {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	subjects := e.subjectsOf(subject)
+	subjects[AnySubject] = true
+
+	allow := false
+	for _, p := range e.policies {
+		if !subjects[p.Subject] || !matchAction(action, p.Action) || !e.ObjectMatcher(object, p.Object) {
+			continue
+		}
+		if p.Deny {
+			return false
+		}
+		allow = true
+	}
+	return allow
+}
+
+// subject with all inherited roles, the expired groupings are skipped
+func (e *Enforcer) subjectsOf(subject string) map[string]bool {
+	now := time.Now()
+	subjects := map[string]bool{subject: true}
+	queue := []string{subject}
+	for len(queue) > 0 {
+		sub := queue[0]
+		queue = queue[1:]
+		for _, g := range e.groupings[sub] {
+			if !g.expiresAt.IsZero() && !g.expiresAt.After(now) {
+				continue
+			}
+			if !subjects[g.role] {
+				subjects[g.role] = true
+				queue = append(queue, g.role)
+			}
+		}
+	}
+	return subjects
+}
+
+func matchAction(action, pattern string) bool {
+	return pattern == "*" || strings.EqualFold(action, pattern)
+}
+
+// KeyMatch "/user/*" matches "/user/1" and "/user/1/roles"
+func KeyMatch(key, pattern string) bool {
+	i := strings.Index(pattern, "*")
+	if i == -1 {
+		return key == pattern
+	}
+	if len(key) > i {
+		return key[:i] == pattern[:i]
+	}
+	return key == pattern[:i]
+}
+
+var keyMatch2Param = regexp.MustCompile(`:[^/]+`)
+
+// KeyMatch2 like KeyMatch, and "/user/:id" matches "/user/1"
+func KeyMatch2(key, pattern string) bool {
+	pattern = strings.ReplaceAll(pattern, "/*", "/.*")
+	pattern = keyMatch2Param.ReplaceAllString(pattern, "[^/]+")
+	return RegexMatch(key, "^"+pattern+"$")
+}
+
+// RegexMatch key matches the regular expression pattern
+func RegexMatch(key, pattern string) bool {
+	matched, err := regexp.MatchString(pattern, key)
+	return err == nil && matched
+}
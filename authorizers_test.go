@@ -0,0 +1,143 @@
+package rabbit
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyMatch(t *testing.T) {
+	assert.True(t, KeyMatch("/user/1", "/user/*"))
+	assert.True(t, KeyMatch("/user/1/roles", "/user/*"))
+	assert.False(t, KeyMatch("/role/1", "/user/*"))
+	assert.True(t, KeyMatch("/user", "/user"))
+
+	assert.True(t, KeyMatch2("/user/1", "/user/:id"))
+	assert.True(t, KeyMatch2("/user/:key", "/user/:id"))
+	assert.False(t, KeyMatch2("/user/1/roles", "/user/:id"))
+	assert.True(t, KeyMatch2("/user/1/roles", "/user/*"))
+
+	assert.True(t, RegexMatch("/user/12", `^/user/\d+$`))
+	assert.False(t, RegexMatch("/user/abc", `^/user/\d+$`))
+}
+
+func TestEnforcer(t *testing.T) {
+	e := NewEnforcer()
+	err := e.LoadPolicyText(`
+	# roles
+	p, admin, /user/*, *
+	p, support, /user/:id, GET
+	p, support, /user/:id, DELETE, deny
+	p, *, /ping, GET
+	g, 1, admin
+	g, 1, support
+	g, 2, support
+	g, 3, ops
+	g, ops, admin
+	`)
+	assert.Nil(t, err)
+
+	assert.True(t, e.Enforce("1", "/user/1", "GET"))
+	assert.False(t, e.Enforce("1", "/user/1", "DELETE")) // deny > allow
+	assert.True(t, e.Enforce("2", "/user/1", "GET"))
+	assert.False(t, e.Enforce("2", "/user/1", "POST"))
+	assert.True(t, e.Enforce("3", "/user/1", "DELETE")) // inherits admin
+	assert.True(t, e.Enforce("4", "/ping", "GET"))
+	assert.False(t, e.Enforce("4", "/user/1", "GET"))
+
+	e2 := NewEnforcer()
+	assert.Nil(t, e2.LoadPolicyText(e.PolicyText()))
+	assert.Equal(t, e.PolicyText(), e2.PolicyText())
+
+	err = e.LoadPolicyText("x, 1, 2")
+	assert.Contains(t, err.Error(), "line 1")
+
+	// expired grouping
+	err = e.LoadPolicyText("g, 5, admin, 2020-01-01T00:00:00Z\ng, 6, admin, 2999-01-01T00:00:00Z")
+	assert.Nil(t, err)
+	assert.False(t, e.Enforce("5", "/user/1", "GET"))
+	assert.True(t, e.Enforce("6", "/user/1", "GET"))
+	assert.Contains(t, e.PolicyText(), "g, 6, admin, 2999-01-01T00:00:00Z")
+	err = e.LoadPolicyText("g, 7, admin, tomorrow")
+	assert.Contains(t, err.Error(), "invalid expiration")
+}
+
+func TestCasbinAuthorizer(t *testing.T) {
+	db, r, client := initTestClient(t)
+	SetValue(db, KEY_API_NEED_AUTH, "true")
+
+	err := client.CallPost("/auth/register", RegisterUserForm{Email: "bob@example.org", Password: "123456"}, nil)
+	assert.Nil(t, err)
+	bob, _ := GetUserByEmail(db, "bob@example.org")
+
+	pList, _ := SavePermission(db, 0, 0, "list user", "/user", http.MethodGet, false)
+	pDelete, _ := SavePermission(db, 0, 0, "delete user", "/user/:key", http.MethodDelete, false)
+	pPing, _ := SavePermission(db, 0, 0, "ping", "/ping", http.MethodGet, true)
+	admin, _ := AddRoleWithPermissions(db, "admin", "ADMIN", []uint{pList.ID, pDelete.ID})
+	AddRoleForUser(db, bob.ID, admin.ID)
+	group, _ := CreateGroupByUser(db, bob.ID, "contractors")
+	SetGroupPermission(db, group.ID, pDelete.ID, true)
+
+	authorizer, err := NewCasbinAuthorizer(db)
+	assert.Nil(t, err)
+	assert.Contains(t, authorizer.Enforcer.PolicyText(), "p, group:contractors, /user/:key, DELETE, deny")
+
+	// same decisions as the default authorizer
+	for _, c := range []struct{ uri, method string }{
+		{pList.Uri, pList.Method},
+		{pDelete.Uri, pDelete.Method},
+		{pPing.Uri, pPing.Method},
+		{"/not-exist", http.MethodGet},
+	} {
+		expected, _ := GormAuthorizer{}.Authorize(db, bob, c.uri, c.method)
+		actual, _ := authorizer.Authorize(db, bob, c.uri, c.method)
+		assert.Equal(t, expected, actual, c.uri)
+	}
+
+	ar := r.Group("/api").Use(WithAuthentication(), WithAuthorizationBy("/api", authorizer))
+	ar.GET("/user", func(ctx *gin.Context) { ctx.JSON(http.StatusOK, true) })
+	ar.DELETE("/user/:key", func(ctx *gin.Context) { ctx.JSON(http.StatusOK, true) })
+
+	w := client.Get("/api/user")
+	assert.Equal(t, http.StatusOK, w.Code)
+	err = client.CallDelete("/api/user/1", nil, nil)
+	assert.Contains(t, err.Error(), "permission denied")
+
+	// role names never collide with other subjects
+	alice, _ := CreateUser(db, "alice@example.org", "123456")
+	AddRoleWithPermissions(db, "*", "ANY", []uint{pList.ID})
+	AddRoleWithPermissions(db, strconv.Itoa(int(alice.ID)), "ALICE", []uint{pList.ID})
+	carol, _ := CreateUser(db, "carol@example.org", "123456")
+	contractors, _ := CreateRole(db, "group:contractors", "CONTRACTORS")
+	AddRoleForUser(db, carol.ID, admin.ID)
+	AddRoleForUser(db, carol.ID, contractors.ID)
+	assert.Nil(t, authorizer.Enforcer.LoadFromDB(db))
+
+	ok, _ := authorizer.Authorize(db, alice, pList.Uri, pList.Method)
+	assert.False(t, ok)
+	ok, _ = authorizer.Authorize(db, carol, pDelete.Uri, pDelete.Method)
+	assert.True(t, ok)
+
+	// the temporary grant expires without reload
+	AddRoleForUserUntil(db, alice.ID, admin.ID, time.Now().Add(200*time.Millisecond), bob.ID)
+	assert.Nil(t, authorizer.Enforcer.LoadFromDB(db))
+	ok, _ = authorizer.Authorize(db, alice, pList.Uri, pList.Method)
+	assert.True(t, ok)
+	time.Sleep(300 * time.Millisecond)
+	ok, _ = authorizer.Authorize(db, alice, pList.Uri, pList.Method)
+	assert.False(t, ok)
+
+	// the revoked role is applied by reloading
+	stop := authorizer.StartReloading(db, 50*time.Millisecond)
+	defer stop()
+	_, err = RevokeRoleFromUsers(db, admin.ID, []uint{carol.ID})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		ok, _ := authorizer.Authorize(db, carol, pList.Uri, pList.Method)
+		return !ok
+	}, time.Second, 20*time.Millisecond)
+}
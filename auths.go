@@ -2,8 +2,11 @@ package rabbit
 
 import (
 	"errors"
+	"sync"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // group
@@ -38,18 +41,18 @@ func CreateGroupByUser(db *gorm.DB, uid uint, name string) (*Group, error) {
 	group := Group{
 		Name: name,
 	}
-	result := db.Create(&group)
-	if result.Error != nil {
-		return nil, result.Error
-	}
-
-	member := GroupMember{
-		UserID:  uid,
-		GroupID: group.ID,
-	}
-	result = db.Create(&member)
-	if result.Error != nil {
-		return nil, result.Error
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&group).Error; err != nil {
+			return err
+		}
+		member := GroupMember{
+			UserID:  uid,
+			GroupID: group.ID,
+		}
+		return tx.Create(&member).Error
+	})
+	if err != nil {
+		return nil, err
 	}
 	return &group, nil
 }
@@ -73,13 +76,108 @@ func GetRoleByName(db *gorm.DB, name string) (*Role, error) {
 	return Get(db, &Role{Name: name})
 }
 
+// GetRolesByUser return the roles of user, expired grants are ignored
 func GetRolesByUser(db *gorm.DB, uid uint) ([]*Role, error) {
 	var user User
-	result := db.Model(&User{}).Preload("Roles").Take(&user, uid)
+	result := db.Model(&User{}).Take(&user, uid)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	var roles []*Role
+	result = db.Where("id IN (?)", userRoleIDsQuery(db, uid)).Order("id").Find(&roles)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return roles, nil
+}
+
+// GetRoleWithPermissions return the role with the allowed and denied permissions, the denied ones are marked by Deny
+func GetRoleWithPermissions(db *gorm.DB, rid uint) (*Role, error) {
+	var role Role
+	result := db.Model(&Role{}).Preload("Permissions").Take(&role, rid)
 	if result.Error != nil {
 		return nil, result.Error
 	}
-	return user.Roles, nil
+	if err := markRoleDenies(db, rid, role.Permissions); err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// mark the permissions denied by the role
+func markRoleDenies(db *gorm.DB, rid uint, ps []*Permission) error {
+	var denied []uint
+	result := db.Model(&RolePermission{}).
+		Where("role_id", rid).
+		Where("deny", true).
+		Pluck("permission_id", &denied)
+	if result.Error != nil {
+		return result.Error
+	}
+	isDenied := make(map[uint]bool, len(denied))
+	for _, pid := range denied {
+		isDenied[pid] = true
+	}
+	for _, p := range ps {
+		p.Deny = isDenied[p.ID]
+	}
+	return nil
+}
+
+type RoleItem struct {
+	Role
+	PermissionCount int `json:"permissionCount"`
+}
+
+// ListRoles list roles by page, page start from 1
+func ListRoles(db *gorm.DB, page, pageSize int) ([]*RoleItem, int, error) {
+	if page <= 0 {
+		page = 1
+	}
+	if pageSize <= 0 {
+		pageSize = 20
+	}
+
+	var total int64
+	if err := db.Model(&Role{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var roles []Role
+	result := db.Model(&Role{}).Order("id").Offset((page - 1) * pageSize).Limit(pageSize).Find(&roles)
+	if result.Error != nil {
+		return nil, 0, result.Error
+	}
+
+	rids := make([]uint, 0, len(roles))
+	for _, r := range roles {
+		rids = append(rids, r.ID)
+	}
+
+	var counts []struct {
+		RoleID uint
+		Count  int
+	}
+	result = db.Model(&RolePermission{}).
+		Select("role_id, count(*) as count").
+		Where("role_id", rids).
+		Group("role_id").
+		Scan(&counts)
+	if result.Error != nil {
+		return nil, 0, result.Error
+	}
+
+	countMap := make(map[uint]int, len(counts))
+	for _, c := range counts {
+		countMap[c.RoleID] = c.Count
+	}
+
+	items := make([]*RoleItem, 0, len(roles))
+	for _, r := range roles {
+		items = append(items, &RoleItem{Role: r, PermissionCount: countMap[r.ID]})
+	}
+	return items, int(total), nil
 }
 
 func CheckRoleInUse(db *gorm.DB, rid uint) (bool, error) {
@@ -104,73 +202,78 @@ func CreateRole(db *gorm.DB, name, label string) (*Role, error) {
 	return AddRoleWithPermissions(db, name, label, nil)
 }
 
+// multi-step mutations run in a transaction, nested in the outer one if db is a transaction
 func AddRoleWithPermissions(db *gorm.DB, name, label string, ps []uint) (*Role, error) {
 	role := Role{
 		Name:  name,
 		Label: label,
 	}
-	result := db.Create(&role)
-	if result.Error != nil {
-		return nil, result.Error
-	}
-
-	// add new permissions related to this role
-	for _, pid := range ps {
-		rolePermission := RolePermission{
-			RoleID:       role.ID,
-			PermissionID: pid,
-		}
-		result := db.Create(&rolePermission)
-		if result.Error != nil {
-			return nil, result.Error
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&role).Error; err != nil {
+			return err
 		}
+		// add new permissions related to this role
+		return addRolePermissions(tx, role.ID, ps)
+	})
+	if err != nil {
+		return nil, err
 	}
-
 	return &role, nil
 }
 
+// UpdateRoleWithPermissions replace the allowed permissions of role, the denied ones are kept,
+// unless they are allowed by ps
 func UpdateRoleWithPermissions(db *gorm.DB, rid uint, name, label string, ps []uint) (*Role, error) {
 	role := Role{
 		ID:    rid,
 		Name:  name,
 		Label: label,
 	}
-
-	// update role, need to clear old permissions related to this role
-	result := db.Model(&role).Select("name", "label").Updates(role)
-	if result.Error != nil {
-		return nil, result.Error
-	}
-	result = db.Delete(&RolePermission{}, "role_id", role.ID)
-	if result.Error != nil {
-		return nil, result.Error
-	}
-
-	// add new permissions related to this role
-	for _, pid := range ps {
-		rolePermission := RolePermission{
-			RoleID:       role.ID,
-			PermissionID: pid,
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// update role, need to clear old permissions related to this role
+		if err := tx.Model(&role).Select("name", "label").Updates(role).Error; err != nil {
+			return err
 		}
-		result := db.Create(&rolePermission)
-		if result.Error != nil {
-			return nil, result.Error
+		if err := tx.Where("role_id", role.ID).Where("deny", false).Delete(&RolePermission{}).Error; err != nil {
+			return err
 		}
+		// add new permissions related to this role
+		return addRolePermissions(tx, role.ID, ps)
+	})
+	if err != nil {
+		return nil, err
 	}
-
 	return &role, nil
 }
 
-func DeleteRole(db *gorm.DB, rid uint) error {
-	result := db.Delete(&RolePermission{}, "role_id", rid)
-	if result.Error != nil {
-		return result.Error
+func addRolePermissions(db *gorm.DB, rid uint, ps []uint) error {
+	if len(ps) == 0 {
+		return nil
 	}
-	result = db.Delete(&Role{}, "id", rid)
-	if result.Error != nil {
-		return result.Error
+	rolePermissions := make([]RolePermission, 0, len(ps))
+	for _, pid := range ps {
+		rolePermissions = append(rolePermissions, RolePermission{
+			RoleID:       rid,
+			PermissionID: pid,
+		})
 	}
-	return nil
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "role_id"}, {Name: "permission_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"deny"}),
+	}).Create(&rolePermissions).Error
+}
+
+// DeleteRole delete role with its grants and members
+func DeleteRole(db *gorm.DB, rid uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&RolePermission{}, "role_id", rid).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&UserRole{}, "role_id", rid).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Role{}, "id", rid).Error
+	})
 }
 
 // permission
@@ -203,11 +306,11 @@ func GetPermission(db *gorm.DB, uri, method string) (*Permission, error) {
 	return Get(db, &Permission{Uri: uri, Method: method})
 }
 
+// GetPermissionsByRole return the allowed and denied permissions of role, the denied ones are marked by Deny
 func GetPermissionsByRole(db *gorm.DB, rid uint) ([]*Permission, error) {
-	var role Role
-	result := db.Model(&Role{}).Preload("Permissions").Take(&role, rid)
-	if result.Error != nil {
-		return nil, result.Error
+	role, err := GetRoleWithPermissions(db, rid)
+	if err != nil {
+		return nil, err
 	}
 	return role.Permissions, nil
 }
@@ -221,6 +324,115 @@ func GetPermissionChildren(db *gorm.DB, pid uint) ([]*Permission, error) {
 	return permissions, nil
 }
 
+// GetPermissionsByUser return the permissions allowed by roles and groups of the user, without denied ones
+func GetPermissionsByUser(db *gorm.DB, uid uint) ([]*Permission, error) {
+	var permissions []*Permission
+	result := db.Model(&Permission{}).
+		Where("id IN (?)", userGrantsQuery(db, uid, false)).
+		Where("id NOT IN (?)", userGrantsQuery(db, uid, true)).
+		Order("id").
+		Find(&permissions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return permissions, nil
+}
+
+// GetPermissionTree return root permissions, with children filled recursively
+func GetPermissionTree(db *gorm.DB) ([]*Permission, error) {
+	var permissions []*Permission
+	result := db.Model(&Permission{}).Order("id").Find(&permissions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return BuildPermissionTree(permissions), nil
+}
+
+// BuildPermissionTree build tree by ParentID, the permission whose parent not in the list is root
+func BuildPermissionTree(permissions []*Permission) []*Permission {
+	nodes := make(map[uint]*Permission, len(permissions))
+	for _, p := range permissions {
+		p.Children = nil
+		nodes[p.ID] = p
+	}
+
+	roots := []*Permission{}
+	for _, p := range permissions {
+		parent, ok := nodes[p.ParentID]
+		if p.ParentID == 0 || !ok || parent == p {
+			roots = append(roots, p)
+			continue
+		}
+		parent.Children = append(parent.Children, p)
+	}
+	return roots
+}
+
+// SetPermissionMenu set the menu metadata of permission
+func SetPermissionMenu(db *gorm.DB, pid uint, icon string, order int, hidden bool) error {
+	return db.Model(&Permission{ID: pid}).
+		Select("icon", "sort_order", "hidden").
+		Updates(Permission{Icon: icon, Order: order, Hidden: hidden}).Error
+}
+
+/*
+GetMenuByUser return the permission tree the user can access, same rules as CheckUserPermission
+1. superuser can access all permissions
+2. hidden permissions are removed with their children
+3. the parent is kept if any child can be accessed, the leaves without uri (named permissions) are not menus
+4. siblings are sorted by order, then id
+*/
+func GetMenuByUser(db *gorm.DB, user *User) ([]*Permission, error) {
+	var permissions []*Permission
+	result := db.Model(&Permission{}).Order("sort_order, id").Find(&permissions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	allowed := map[uint]bool{}
+	if user.IsSuperUser {
+		// 1
+		for _, p := range permissions {
+			allowed[p.ID] = true
+		}
+	} else {
+		var ids []uint
+		result := db.Model(&Permission{}).
+			Where("id IN (?) OR anonymous = ?", userGrantsQuery(db, user.ID, false), true).
+			Where("id NOT IN (?)", userGrantsQuery(db, user.ID, true)).
+			Pluck("id", &ids)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		for _, id := range ids {
+			allowed[id] = true
+		}
+	}
+
+	// 4
+	return pruneMenu(BuildPermissionTree(permissions), allowed), nil
+}
+
+func pruneMenu(nodes []*Permission, allowed map[uint]bool) []*Permission {
+	menu := []*Permission{}
+	for _, p := range nodes {
+		// 2
+		if p.Hidden {
+			continue
+		}
+		// 3
+		p.Children = pruneMenu(p.Children, allowed)
+		if len(p.Children) == 0 {
+			p.Children = nil
+			if !allowed[p.ID] || p.Uri == "" {
+				continue
+			}
+		}
+		menu = append(menu, p)
+	}
+	return menu
+}
+
 func CheckPermissionInUse(db *gorm.DB, pid uint) (bool, error) {
 	var count int64
 	result := db.Model(&RolePermission{}).Where("permission_id", pid).Count(&count)
@@ -239,37 +451,47 @@ func CheckPermissionNameExist(db *gorm.DB, name string) (bool, error) {
 	return count > 0, nil
 }
 
-// if the permission is a parent permission, delete all its children
+// if the permission is a parent permission, delete all its descendants
+// grants of the deleted permissions are deleted too
 func DeletePermission(db *gorm.DB, pid uint) error {
-	p, err := GetPermissionByID(db, pid)
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil
-		}
-		return err
-	}
-
-	if p.ParentID == 0 {
-		children, err := GetPermissionChildren(db, pid)
-		if err != nil {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if _, err := GetPermissionByID(tx, pid); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
 			return err
 		}
+
+		// the visited ids stop the cycles of parent_id
 		ids := []uint{pid}
-		for _, child := range children {
-			ids = append(ids, child.ID)
+		visited := map[uint]bool{pid: true}
+		for parents := ids; len(parents) > 0; {
+			var children []uint
+			if err := tx.Model(&Permission{}).Where("parent_id IN ?", parents).Pluck("id", &children).Error; err != nil {
+				return err
+			}
+			parents = nil
+			for _, id := range children {
+				if !visited[id] {
+					visited[id] = true
+					parents = append(parents, id)
+				}
+			}
+			ids = append(ids, parents...)
 		}
-		result := db.Delete(&Permission{}, "id", ids)
-		if result.Error != nil {
-			return result.Error
-		}
-	} else {
-		result := db.Delete(&Permission{}, "id", pid)
-		if result.Error != nil {
-			return result.Error
-		}
-	}
 
-	return nil
+		return deletePermissions(tx, ids)
+	})
+}
+
+func deletePermissions(tx *gorm.DB, ids []uint) error {
+	if err := tx.Delete(&RolePermission{}, "permission_id", ids).Error; err != nil {
+		return err
+	}
+	if err := tx.Delete(&GroupPermission{}, "permission_id", ids).Error; err != nil {
+		return err
+	}
+	return tx.Delete(&Permission{}, "id", ids).Error
 }
 
 // user
@@ -291,46 +513,264 @@ func GetUsersByRole(db *gorm.DB, rid uint) ([]*User, error) {
 	return role.Users, nil
 }
 
+// AddRoleForUser grant role to user permanently, the expired or temporary grant is replaced
 func AddRoleForUser(db *gorm.DB, uid uint, rid uint) error {
 	userRole := UserRole{
 		UserID: uid,
 		RoleID: rid,
 	}
-	return db.Model(&userRole).Create(userRole).Error
+	return db.Clauses(userRoleUpsert()).Create(&userRole).Error
+}
+
+/*
+AddRoleForUserUntil grant role to user until expiresAt, grant again to extend
+1. the permanent grant is never replaced by a temporary one
+2. the temporary grant is only extended, not shortened
+*/
+func AddRoleForUserUntil(db *gorm.DB, uid, rid uint, expiresAt time.Time, grantedBy uint) error {
+	expiresAt = expiresAt.UTC()
+	return db.Transaction(func(tx *gorm.DB) error {
+		var current []*UserRole
+		if err := tx.Where("user_id", uid).Where("role_id", rid).Limit(1).Find(&current).Error; err != nil {
+			return err
+		}
+		if len(current) == 0 {
+			return tx.Create(&UserRole{
+				UserID:    uid,
+				RoleID:    rid,
+				ExpiresAt: &expiresAt,
+				GrantedBy: grantedBy,
+			}).Error
+		}
+
+		// 1
+		if current[0].ExpiresAt == nil {
+			return nil
+		}
+		// 2
+		if !expiresAt.After(*current[0].ExpiresAt) {
+			return nil
+		}
+		return tx.Model(&UserRole{}).
+			Where("user_id", uid).
+			Where("role_id", rid).
+			Where("expires_at IS NOT NULL").
+			Updates(map[string]any{"expires_at": expiresAt, "granted_by": grantedBy}).Error
+	})
 }
 
+// SigRoleExpired: userRole *UserRole
+const SigRoleExpired = "role.expired"
+
+// SweepExpiredRoles delete the expired grants, emit SigRoleExpired for each one
+func SweepExpiredRoles(db *gorm.DB) (int, error) {
+	now := time.Now().UTC()
+
+	var expired []*UserRole
+	result := db.Where("expires_at <= ?", now).Find(&expired)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	count := 0
+	for _, ur := range expired {
+		// the grant may be extended after query
+		result := db.Where("user_id = ? AND role_id = ? AND expires_at <= ?", ur.UserID, ur.RoleID, now).
+			Delete(&UserRole{})
+		if result.Error != nil {
+			return count, result.Error
+		}
+		if result.RowsAffected > 0 {
+			count++
+			Sig().Emit(SigRoleExpired, ur)
+		}
+	}
+	return count, nil
+}
+
+// StartRoleSweeper run SweepExpiredRoles every interval in background, until stop is called
+func StartRoleSweeper(db *gorm.DB, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := SweepExpiredRoles(db); err != nil {
+					Warningln("sweep expired roles fail:", err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+/*
+UpdateRolesForUser make the roles of user exactly rids, in a transaction
+1. the unexpired grants in rids are kept with their expiration
+2. the roles not in rids are revoked
+3. the others are granted permanently, the expired grants are replaced
+*/
 func UpdateRolesForUser(db *gorm.DB, uid uint, rids []uint) (*User, error) {
 	user := User{
 		ID: uid,
 	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var current []uint
+		result := tx.Model(&UserRole{}).
+			Where("user_id", user.ID).
+			Where("expires_at IS NULL OR expires_at > ?", time.Now().UTC()).
+			Pluck("role_id", &current)
+		if result.Error != nil {
+			return result.Error
+		}
+		has := map[uint]bool{}
+		for _, rid := range current {
+			has[rid] = true
+		}
+
+		// 2
+		revoke := tx.Where("user_id", user.ID)
+		if len(rids) > 0 {
+			revoke = revoke.Where("role_id NOT IN ?", rids)
+		}
+		if err := revoke.Delete(&UserRole{}).Error; err != nil {
+			return err
+		}
+
+		// 1, 3
+		seen := map[uint]bool{}
+		userRoles := make([]UserRole, 0, len(rids))
+		for _, rid := range rids {
+			if has[rid] || seen[rid] {
+				continue
+			}
+			seen[rid] = true
+			userRoles = append(userRoles, UserRole{
+				UserID: user.ID,
+				RoleID: rid,
+			})
+		}
+		if len(userRoles) == 0 {
+			return nil
+		}
+		return tx.Clauses(userRoleUpsert()).Create(&userRoles).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
 
-	result := db.Delete(&UserRole{}, "user_id", user.ID)
-	if result.Error != nil {
-		return nil, result.Error
+// grant
+func SetRolePermission(db *gorm.DB, rid, pid uint, deny bool) error {
+	rolePermission := RolePermission{
+		RoleID:       rid,
+		PermissionID: pid,
+		Deny:         deny,
 	}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "role_id"}, {Name: "permission_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"deny"}),
+	}).Create(&rolePermission).Error
+}
 
-	for _, roleID := range rids {
-		if err := AddRoleForUser(db, user.ID, roleID); err != nil {
-			return nil, err
+// UpdateRoleDenyPermissions replace the denied permissions of role
+func UpdateRoleDenyPermissions(db *gorm.DB, rid uint, ps []uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("role_id", rid).Where("deny", true).Delete(&RolePermission{}).Error; err != nil {
+			return err
 		}
+		return SetRoleDenyPermissions(tx, rid, ps)
+	})
+}
+
+func SetRoleDenyPermissions(db *gorm.DB, rid uint, ps []uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, pid := range ps {
+			if err := SetRolePermission(tx, rid, pid, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func SetGroupPermission(db *gorm.DB, gid, pid uint, deny bool) error {
+	groupPermission := GroupPermission{
+		GroupID:      gid,
+		PermissionID: pid,
+		Deny:         deny,
 	}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "group_id"}, {Name: "permission_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"deny"}),
+	}).Create(&groupPermission).Error
+}
 
-	return &user, nil
+func RemoveGroupPermission(db *gorm.DB, gid, pid uint) error {
+	return db.Where("group_id = ? AND permission_id = ?", gid, pid).Delete(&GroupPermission{}).Error
 }
 
+// ids of the roles granted to the user, without expired ones
+func userRoleIDsQuery(db *gorm.DB, uid uint) *gorm.DB {
+	return db.Model(&UserRole{}).
+		Select("role_id").
+		Where("user_id", uid).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now().UTC())
+}
+
+func userGroupIDsQuery(db *gorm.DB, uid uint) *gorm.DB {
+	return db.Model(&GroupMember{}).Select("group_id").Where("user_id", uid)
+}
+
+// ids of the permissions allowed (or denied) to the user through roles and groups
+func userGrantsQuery(db *gorm.DB, uid uint, deny bool) *gorm.DB {
+	byRole := db.Model(&RolePermission{}).
+		Select("permission_id").
+		Where("deny", deny).
+		Where("role_id IN (?)", userRoleIDsQuery(db, uid))
+	byGroup := db.Model(&GroupPermission{}).
+		Select("permission_id").
+		Where("deny", deny).
+		Where("group_id IN (?)", userGroupIDsQuery(db, uid))
+	return db.Raw("? UNION ?", byRole, byGroup)
+}
+
+/*
+Permission evaluation order, the first matched rule wins:
+1. explicit deny: a role or group of the user denies the permission
+2. explicit allow: a role or group of the user allows the permission
+3. anonymous: the permission is open to any user
+4. default deny: the permission not exists or not granted
+*/
+
 // check
 func CheckRolePermission(db *gorm.DB, rid uint, uri, method string) (bool, error) {
-	ps, err := GetPermissionsByRole(db, rid)
+	p, err := GetPermission(db, uri, method)
 	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
 		return false, err
 	}
 
-	for _, p := range ps {
-		if p.Anonymous || (p.Uri == uri && p.Method == method) {
-			return true, nil
-		}
+	var rolePermission RolePermission
+	result := db.Where("role_id = ? AND permission_id = ?", rid, p.ID).Take(&rolePermission)
+	if result.Error == nil {
+		return !rolePermission.Deny, nil
+	}
+	if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return false, result.Error
 	}
-	return false, nil
+	return p.Anonymous, nil
 }
 
 func CheckUserPermission(db *gorm.DB, uid uint, uri, method string) (bool, error) {
@@ -341,25 +781,252 @@ func CheckUserPermission(db *gorm.DB, uid uint, uri, method string) (bool, error
 		}
 		return false, err
 	}
-	if p.Anonymous {
+
+	allow, deny, err := getUserGrants(db, uid, p.ID)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case deny:
+		return false, nil
+	case allow:
 		return true, nil
+	default:
+		return p.Anonymous, nil
 	}
+}
 
-	rs, err := GetRolesByUser(db, uid)
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return false, nil
+// check if the permission is allowed or denied by any role or group of the user
+func getUserGrants(db *gorm.DB, uid, pid uint) (allow, deny bool, err error) {
+	var denies []bool
+	result := db.Model(&RolePermission{}).
+		Where("permission_id", pid).
+		Where("role_id IN (?)", userRoleIDsQuery(db, uid)).
+		Pluck("deny", &denies)
+	if result.Error != nil {
+		return false, false, result.Error
+	}
+
+	var groupDenies []bool
+	result = db.Model(&GroupPermission{}).
+		Where("permission_id", pid).
+		Where("group_id IN (?)", userGroupIDsQuery(db, uid)).
+		Pluck("deny", &groupDenies)
+	if result.Error != nil {
+		return false, false, result.Error
+	}
+
+	for _, d := range append(denies, groupDenies...) {
+		if d {
+			deny = true
+		} else {
+			allow = true
 		}
+	}
+	return allow, deny, nil
+}
+
+// named permission, e.g. "invoice.approve", for the checks outside HTTP
+// granted in the same way as the uri permissions, "invoice.*" and "*" are wildcards
+
+// HasPermission check the named permission, same order as CheckUserPermission
+func HasPermission(db *gorm.DB, uid uint, name string) (bool, error) {
+	candidates := permissionNameCandidates(name)
+
+	var grants []struct {
+		Deny bool
+	}
+	byRole := db.Table("? AS role_permissions", tableOf(db, &RolePermission{})).
+		Select("role_permissions.deny").
+		Joins("JOIN ? AS permissions ON permissions.id = role_permissions.permission_id", tableOf(db, &Permission{})).
+		Where("permissions.name IN ?", candidates).
+		Where("role_permissions.role_id IN (?)", userRoleIDsQuery(db, uid))
+	byGroup := db.Table("? AS group_permissions", tableOf(db, &GroupPermission{})).
+		Select("group_permissions.deny").
+		Joins("JOIN ? AS permissions ON permissions.id = group_permissions.permission_id", tableOf(db, &Permission{})).
+		Where("permissions.name IN ?", candidates).
+		Where("group_permissions.group_id IN (?)", userGroupIDsQuery(db, uid))
+	if err := db.Raw("? UNION ALL ?", byRole, byGroup).Scan(&grants).Error; err != nil {
 		return false, err
 	}
 
-	for _, r := range rs {
-		if pass, _ := CheckRolePermission(db, r.ID, uri, method); pass {
-			return true, nil
+	allow := false
+	for _, g := range grants {
+		if g.Deny {
+			return false, nil
+		}
+		allow = true
+	}
+	if allow {
+		return true, nil
+	}
+
+	var count int64
+	result := db.Model(&Permission{}).Where("name IN ?", candidates).Where("anonymous", true).Count(&count)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return count > 0, nil
+}
+
+// "invoice.item.approve" => ["invoice.item.approve", "invoice.item.*", "invoice.*", "*"]
+func permissionNameCandidates(name string) []string {
+	candidates := []string{name}
+	for i := len(name) - 1; i >= 0; i-- {
+		if name[i] == '.' {
+			candidates = append(candidates, name[:i+1]+"*")
+		}
+	}
+	return append(candidates, "*")
+}
+
+// explain
+const (
+	GrantNone  = ""
+	GrantAllow = "allow"
+	GrantDeny  = "deny"
+)
+
+type PermissionGrantTrace struct {
+	Kind  string `json:"kind"` // role or group
+	ID    uint   `json:"id"`
+	Name  string `json:"name"`
+	Grant string `json:"grant"` // allow, deny or empty
+}
+
+type PermissionExplain struct {
+	UserID       uint                    `json:"userId"`
+	Uri          string                  `json:"uri"`
+	Method       string                  `json:"method"`
+	Allowed      bool                    `json:"allowed"`
+	Reason       string                  `json:"reason"`
+	AuthDisabled bool                    `json:"authDisabled"` // KEY_API_NEED_AUTH is false
+	SuperUser    bool                    `json:"superUser"`
+	Permission   *Permission             `json:"permission,omitempty"`
+	Considered   []*PermissionGrantTrace `json:"considered"`
+	DecidedBy    *PermissionGrantTrace   `json:"decidedBy,omitempty"`
+}
+
+/*
+ExplainUserPermission trace how the access of user to uri with method is decided
+1. KEY_API_NEED_AUTH is false, allow all
+2. superuser, allow all
+3. evaluate grants of roles and groups, same order as CheckUserPermission
+*/
+func ExplainUserPermission(db *gorm.DB, uid uint, uri, method string) (*PermissionExplain, error) {
+	var user User
+	if err := db.Take(&user, uid).Error; err != nil {
+		return nil, err
+	}
+
+	needAuth, err := GetSetting[bool](db, KEY_API_NEED_AUTH)
+	if err != nil {
+		return nil, err
+	}
+
+	explain := &PermissionExplain{
+		UserID:       uid,
+		Uri:          uri,
+		Method:       method,
+		AuthDisabled: !needAuth,
+		SuperUser:    user.IsSuperUser,
+		Considered:   []*PermissionGrantTrace{},
+	}
+
+	// 3
+	p, err := GetPermission(db, uri, method)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if p != nil {
+		explain.Permission = p
+		if err := explainUserGrants(db, explain); err != nil {
+			return nil, err
 		}
 	}
 
-	return false, nil
+	switch {
+	case explain.AuthDisabled: // 1
+		explain.Allowed, explain.Reason = true, "authorization disabled"
+	case explain.SuperUser: // 2
+		explain.Allowed, explain.Reason = true, "superuser"
+	case p == nil:
+		explain.Allowed, explain.Reason = false, "permission not found"
+	default:
+		for _, trace := range explain.Considered {
+			if trace.Grant == GrantDeny {
+				explain.DecidedBy = trace
+				break
+			}
+			if trace.Grant == GrantAllow && explain.DecidedBy == nil {
+				explain.DecidedBy = trace
+			}
+		}
+		switch {
+		case explain.DecidedBy != nil && explain.DecidedBy.Grant == GrantDeny:
+			explain.Allowed, explain.Reason = false, "denied by "+explain.DecidedBy.Kind
+		case explain.DecidedBy != nil:
+			explain.Allowed, explain.Reason = true, "allowed by "+explain.DecidedBy.Kind
+		case p.Anonymous:
+			explain.Allowed, explain.Reason = true, "anonymous"
+		default:
+			explain.Allowed, explain.Reason = false, "not granted"
+		}
+	}
+	return explain, nil
+}
+
+func explainUserGrants(db *gorm.DB, explain *PermissionExplain) error {
+	var roles []*Role
+	if err := db.Where("id IN (?)", userRoleIDsQuery(db, explain.UserID)).Order("id").Find(&roles).Error; err != nil {
+		return err
+	}
+	var rolePermissions []RolePermission
+	if err := db.Where("permission_id", explain.Permission.ID).Find(&rolePermissions).Error; err != nil {
+		return err
+	}
+	roleGrants := map[uint]string{}
+	for _, rp := range rolePermissions {
+		roleGrants[rp.RoleID] = grantOf(rp.Deny)
+	}
+	for _, r := range roles {
+		explain.Considered = append(explain.Considered, &PermissionGrantTrace{
+			Kind:  "role",
+			ID:    r.ID,
+			Name:  r.Name,
+			Grant: roleGrants[r.ID],
+		})
+	}
+
+	var groups []*Group
+	if err := db.Where("id IN (?)", userGroupIDsQuery(db, explain.UserID)).Order("id").Find(&groups).Error; err != nil {
+		return err
+	}
+	var groupPermissions []GroupPermission
+	if err := db.Where("permission_id", explain.Permission.ID).Find(&groupPermissions).Error; err != nil {
+		return err
+	}
+	groupGrants := map[uint]string{}
+	for _, gp := range groupPermissions {
+		groupGrants[gp.GroupID] = grantOf(gp.Deny)
+	}
+	for _, g := range groups {
+		explain.Considered = append(explain.Considered, &PermissionGrantTrace{
+			Kind:  "group",
+			ID:    g.ID,
+			Name:  g.Name,
+			Grant: groupGrants[g.ID],
+		})
+	}
+	return nil
+}
+
+func grantOf(deny bool) string {
+	if deny {
+		return GrantDeny
+	}
+	return GrantAllow
 }
 
 // for test
@@ -1,14 +1,16 @@
 package rabbit
 
 import (
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"gorm.io/gorm"
 )
 
 func initDB(t *testing.T) *gorm.DB {
-	db := InitDatabase("", "", nil)
+	db := newTestDB(t)
 	err := InitMigrate(db)
 	assert.Nil(t, err)
 
@@ -195,6 +197,23 @@ func TestPermissions(t *testing.T) {
 		assert.Equal(t, int64(0), count)
 	}
 
+	// delete the cycles of parent
+	{
+		self, _ := SavePermission(db, 0, 0, "self", "/self", "GET", false)
+		SavePermission(db, self.ID, self.ID, "self", "/self", "GET", false)
+		a, _ := SavePermission(db, 0, 0, "a", "/a", "GET", false)
+		b, _ := SavePermission(db, 0, a.ID, "b", "/b", "GET", false)
+		SavePermission(db, a.ID, b.ID, "a", "/a", "GET", false)
+
+		err := DeletePermission(db, self.ID)
+		assert.Nil(t, err)
+		err = DeletePermission(db, a.ID)
+		assert.Nil(t, err)
+
+		var count int64
+		db.Model(&Permission{}).Where("id in (?)", []uint{self.ID, a.ID, b.ID}).Count(&count)
+		assert.Equal(t, int64(0), count)
+	}
 }
 
 func TestCheckPermission(t *testing.T) {
@@ -249,3 +268,428 @@ func TestCheckPermission(t *testing.T) {
 		assert.Nil(t, err)
 	}
 }
+
+func TestPermissionPrecedence(t *testing.T) {
+	db := initDB(t)
+
+	u, _ := CreateUser(db, "test@example.com", "123456")
+	pDelete, _ := SavePermission(db, 0, 0, "delete user", "/user/:key", "DELETE", false)
+	pList, _ := SavePermission(db, 0, 0, "list user", "/user", "GET", true)
+
+	admin, _ := AddRoleWithPermissions(db, "admin", "ADMIN", []uint{pDelete.ID})
+	support, _ := CreateRole(db, "support", "SUPPORT")
+	AddRoleForUser(db, u.ID, admin.ID)
+
+	// explicit allow
+	pass, err := CheckUserPermission(db, u.ID, "/user/:key", "DELETE")
+	assert.Nil(t, err)
+	assert.True(t, pass)
+
+	// explicit deny > explicit allow
+	err = SetRoleDenyPermissions(db, support.ID, []uint{pDelete.ID})
+	assert.Nil(t, err)
+	AddRoleForUser(db, u.ID, support.ID)
+
+	pass, err = CheckUserPermission(db, u.ID, "/user/:key", "DELETE")
+	assert.Nil(t, err)
+	assert.False(t, pass)
+
+	pass, _ = CheckRolePermission(db, admin.ID, "/user/:key", "DELETE")
+	assert.True(t, pass)
+	pass, _ = CheckRolePermission(db, support.ID, "/user/:key", "DELETE")
+	assert.False(t, pass)
+
+	ps, err := GetPermissionsByUser(db, u.ID)
+	assert.Nil(t, err)
+	assert.Len(t, ps, 0)
+
+	// explicit deny > anonymous, by group
+	pass, _ = CheckUserPermission(db, u.ID, "/user", "GET")
+	assert.True(t, pass)
+
+	group, _ := CreateGroupByUser(db, u.ID, "contractors")
+	err = SetGroupPermission(db, group.ID, pList.ID, true)
+	assert.Nil(t, err)
+
+	pass, err = CheckUserPermission(db, u.ID, "/user", "GET")
+	assert.Nil(t, err)
+	assert.False(t, pass)
+
+	// group allow
+	err = SetGroupPermission(db, group.ID, pList.ID, false)
+	assert.Nil(t, err)
+	pass, _ = CheckUserPermission(db, u.ID, "/user", "GET")
+	assert.True(t, pass)
+
+	err = RemoveGroupPermission(db, group.ID, pList.ID)
+	assert.Nil(t, err)
+	err = SetRolePermission(db, support.ID, pDelete.ID, false)
+	assert.Nil(t, err)
+
+	ps, err = GetPermissionsByUser(db, u.ID)
+	assert.Nil(t, err)
+	assert.Len(t, ps, 1)
+}
+
+func TestRoleDenyPermissions(t *testing.T) {
+	db := initDB(t)
+
+	pList, _ := SavePermission(db, 0, 0, "list user", "/user", "GET", false)
+	pDelete, _ := SavePermission(db, 0, 0, "delete user", "/user/:key", "DELETE", false)
+	pExport, _ := SavePermission(db, 0, 0, "export user", "/user/export", "GET", false)
+
+	role, _ := AddRoleWithPermissions(db, "support", "SUPPORT", []uint{pList.ID})
+	SetRoleDenyPermissions(db, role.ID, []uint{pDelete.ID})
+
+	// the denied ones are marked
+	ps, err := GetPermissionsByRole(db, role.ID)
+	assert.Nil(t, err)
+	assert.Len(t, ps, 2)
+	deny := map[uint]bool{}
+	for _, p := range ps {
+		deny[p.ID] = p.Deny
+	}
+	assert.Equal(t, map[uint]bool{pList.ID: false, pDelete.ID: true}, deny)
+
+	// the denied ones are kept
+	_, err = UpdateRoleWithPermissions(db, role.ID, "support", "SUPPORT", []uint{pExport.ID})
+	assert.Nil(t, err)
+	pass, _ := CheckRolePermission(db, role.ID, "/user/:key", "DELETE")
+	assert.False(t, pass)
+	pass, _ = CheckRolePermission(db, role.ID, "/user", "GET")
+	assert.False(t, pass)
+
+	var count int64
+	db.Model(&RolePermission{}).Where("role_id", role.ID).Where("deny", true).Count(&count)
+	assert.Equal(t, int64(1), count)
+
+	// unless allowed explicitly
+	_, err = UpdateRoleWithPermissions(db, role.ID, "support", "SUPPORT", []uint{pExport.ID, pDelete.ID})
+	assert.Nil(t, err)
+	pass, _ = CheckRolePermission(db, role.ID, "/user/:key", "DELETE")
+	assert.True(t, pass)
+
+	// replace the denied ones
+	err = UpdateRoleDenyPermissions(db, role.ID, []uint{pList.ID})
+	assert.Nil(t, err)
+	err = UpdateRoleDenyPermissions(db, role.ID, []uint{pExport.ID})
+	assert.Nil(t, err)
+	role, _ = GetRoleWithPermissions(db, role.ID)
+	deny = map[uint]bool{}
+	for _, p := range role.Permissions {
+		deny[p.ID] = p.Deny
+	}
+	assert.Equal(t, map[uint]bool{pDelete.ID: false, pExport.ID: true}, deny)
+}
+
+func TestExplainUserPermission(t *testing.T) {
+	db := initDB(t)
+	SetValue(db, KEY_API_NEED_AUTH, "true")
+
+	u, _ := CreateUser(db, "test@example.com", "123456")
+	p, _ := SavePermission(db, 0, 0, "delete user", "/user/:key", "DELETE", false)
+	admin, _ := AddRoleWithPermissions(db, "admin", "ADMIN", []uint{p.ID})
+	support, _ := CreateRole(db, "support", "SUPPORT")
+	AddRoleForUser(db, u.ID, admin.ID)
+	AddRoleForUser(db, u.ID, support.ID)
+
+	explain, err := ExplainUserPermission(db, u.ID, "/user/:key", "DELETE")
+	assert.Nil(t, err)
+	assert.True(t, explain.Allowed)
+	assert.Equal(t, "allowed by role", explain.Reason)
+	assert.Equal(t, p.ID, explain.Permission.ID)
+	assert.Len(t, explain.Considered, 2)
+	assert.Equal(t, "admin", explain.DecidedBy.Name)
+
+	SetRolePermission(db, support.ID, p.ID, true)
+	explain, err = ExplainUserPermission(db, u.ID, "/user/:key", "DELETE")
+	assert.Nil(t, err)
+	assert.False(t, explain.Allowed)
+	assert.Equal(t, "denied by role", explain.Reason)
+	assert.Equal(t, "support", explain.DecidedBy.Name)
+
+	explain, err = ExplainUserPermission(db, u.ID, "/not-exist", "GET")
+	assert.Nil(t, err)
+	assert.False(t, explain.Allowed)
+	assert.Equal(t, "permission not found", explain.Reason)
+
+	// short-circuits
+	UpdateFields(db, u, map[string]any{"IsSuperUser": true})
+	explain, _ = ExplainUserPermission(db, u.ID, "/user/:key", "DELETE")
+	assert.True(t, explain.Allowed)
+	assert.True(t, explain.SuperUser)
+	assert.Equal(t, "superuser", explain.Reason)
+
+	SetValue(db, KEY_API_NEED_AUTH, "false")
+	explain, _ = ExplainUserPermission(db, u.ID, "/user/:key", "DELETE")
+	assert.True(t, explain.Allowed)
+	assert.True(t, explain.AuthDisabled)
+
+	_, err = ExplainUserPermission(db, 999, "/user/:key", "DELETE")
+	assert.NotNil(t, err)
+}
+
+func TestTimeBoundRoles(t *testing.T) {
+	db := initDB(t)
+
+	u, _ := CreateUser(db, "test@example.com", "123456")
+	p, _ := SavePermission(db, 0, 0, "p1", "/p1", "GET", false)
+	oncall, _ := AddRoleWithPermissions(db, "oncall", "ONCALL", []uint{p.ID})
+	contractor, _ := CreateRole(db, "contractor", "CONTRACTOR")
+
+	err := AddRoleForUserUntil(db, u.ID, oncall.ID, time.Now().Add(-time.Minute), 1)
+	assert.Nil(t, err)
+	err = AddRoleForUserUntil(db, u.ID, contractor.ID, time.Now().Add(time.Hour), 1)
+	assert.Nil(t, err)
+
+	roles, err := GetRolesByUser(db, u.ID)
+	assert.Nil(t, err)
+	assert.Len(t, roles, 1)
+	assert.Equal(t, "contractor", roles[0].Name)
+
+	pass, err := CheckUserPermission(db, u.ID, "/p1", "GET")
+	assert.Nil(t, err)
+	assert.False(t, pass)
+
+	// extend the grant
+	err = AddRoleForUserUntil(db, u.ID, oncall.ID, time.Now().Add(time.Hour), 2)
+	assert.Nil(t, err)
+	pass, _ = CheckUserPermission(db, u.ID, "/p1", "GET")
+	assert.True(t, pass)
+
+	var ur UserRole
+	db.Where("user_id = ? AND role_id = ?", u.ID, oncall.ID).Take(&ur)
+	assert.Equal(t, uint(2), ur.GrantedBy)
+
+	// never shorten the grant
+	err = AddRoleForUserUntil(db, u.ID, oncall.ID, time.Now().Add(time.Minute), 3)
+	assert.Nil(t, err)
+	db.Where("user_id = ? AND role_id = ?", u.ID, oncall.ID).Take(&ur)
+	assert.Equal(t, uint(2), ur.GrantedBy)
+	assert.True(t, ur.ExpiresAt.After(time.Now().Add(30*time.Minute)))
+
+	// the permanent grant is kept
+	permanent, _ := CreateRole(db, "permanent", "PERMANENT")
+	AddRoleForUser(db, u.ID, permanent.ID)
+	err = AddRoleForUserUntil(db, u.ID, permanent.ID, time.Now().Add(-time.Second), 3)
+	assert.Nil(t, err)
+	var permanentRole UserRole
+	db.Where("user_id = ? AND role_id = ?", u.ID, permanent.ID).Take(&permanentRole)
+	assert.Nil(t, permanentRole.ExpiresAt)
+
+	// sweep
+	db.Model(&UserRole{}).Where("user_id = ? AND role_id = ?", u.ID, oncall.ID).
+		Update("expires_at", time.Now().UTC().Add(-time.Second))
+
+	var expired []*UserRole
+	Sig().Connect(SigRoleExpired, func(sender any, params ...any) {
+		expired = append(expired, sender.(*UserRole))
+	})
+	defer Sig().DisConnect(SigRoleExpired)
+
+	count, err := SweepExpiredRoles(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	assert.Len(t, expired, 1)
+	assert.Equal(t, oncall.ID, expired[0].RoleID)
+
+	flag, _ := CheckRoleInUse(db, oncall.ID)
+	assert.False(t, flag)
+	flag, _ = CheckRoleInUse(db, contractor.ID)
+	assert.True(t, flag)
+}
+
+func TestRegrantRoles(t *testing.T) {
+	db := initDB(t)
+
+	u, _ := CreateUser(db, "test@example.com", "123456")
+	oncall, _ := CreateRole(db, "oncall", "ONCALL")
+	contractor, _ := CreateRole(db, "contractor", "CONTRACTOR")
+	support, _ := CreateRole(db, "support", "SUPPORT")
+
+	// the expired grant not swept yet is replaced by a permanent one
+	err := AddRoleForUserUntil(db, u.ID, oncall.ID, time.Now().Add(-time.Minute), 1)
+	assert.Nil(t, err)
+	err = AddRoleForUser(db, u.ID, oncall.ID)
+	assert.Nil(t, err)
+	var ur UserRole
+	db.Where("user_id = ? AND role_id = ?", u.ID, oncall.ID).Take(&ur)
+	assert.Nil(t, ur.ExpiresAt)
+
+	// the temporary grant in the list keeps its expiration
+	err = AddRoleForUserUntil(db, u.ID, contractor.ID, time.Now().Add(time.Hour), 2)
+	assert.Nil(t, err)
+	_, err = UpdateRolesForUser(db, u.ID, []uint{contractor.ID, support.ID})
+	assert.Nil(t, err)
+
+	var temporary UserRole
+	db.Where("user_id = ? AND role_id = ?", u.ID, contractor.ID).Take(&temporary)
+	assert.NotNil(t, temporary.ExpiresAt)
+	assert.Equal(t, uint(2), temporary.GrantedBy)
+
+	roles, _ := GetRolesByUser(db, u.ID)
+	assert.Len(t, roles, 2)
+	flag, _ := CheckRoleInUse(db, oncall.ID)
+	assert.False(t, flag)
+}
+
+// make create and delete on the table fail
+func injectFailure(db *gorm.DB, table string) (restore func()) {
+	fail := func(tx *gorm.DB) {
+		if tx.Statement.Table == table {
+			tx.AddError(errors.New("injected failure"))
+		}
+	}
+	db.Callback().Create().Before("gorm:create").Register("test:fail_create", fail)
+	db.Callback().Delete().Before("gorm:delete").Register("test:fail_delete", fail)
+	return func() {
+		db.Callback().Create().Remove("test:fail_create")
+		db.Callback().Delete().Remove("test:fail_delete")
+	}
+}
+
+func TestTransactionalMutations(t *testing.T) {
+	db := initDB(t)
+
+	u, _ := CreateUser(db, "test@example.com", "123456")
+	p1, _ := SavePermission(db, 0, 0, "p1", "/p1", "GET", false)
+	p2, _ := SavePermission(db, 0, 0, "p2", "/p2", "GET", false)
+	role, _ := AddRoleWithPermissions(db, "admin", "ADMIN", []uint{p1.ID})
+	AddRoleForUser(db, u.ID, role.ID)
+
+	// create role with permissions
+	{
+		restore := injectFailure(db, "role_permissions")
+		_, err := AddRoleWithPermissions(db, "support", "SUPPORT", []uint{p1.ID})
+		restore()
+		assert.NotNil(t, err)
+
+		flag, _ := CheckRoleNameExist(db, "support")
+		assert.False(t, flag)
+	}
+
+	// update role with permissions
+	{
+		restore := injectFailure(db, "role_permissions")
+		_, err := UpdateRoleWithPermissions(db, role.ID, "root", "ROOT", []uint{p2.ID})
+		restore()
+		assert.NotNil(t, err)
+
+		r, _ := GetRoleWithPermissions(db, role.ID)
+		assert.Equal(t, "admin", r.Name)
+		assert.Len(t, r.Permissions, 1)
+		assert.Equal(t, p1.ID, r.Permissions[0].ID)
+	}
+
+	// update roles for user
+	{
+		other, _ := CreateRole(db, "other", "OTHER")
+		restore := injectFailure(db, "user_roles")
+		_, err := UpdateRolesForUser(db, u.ID, []uint{other.ID})
+		restore()
+		assert.NotNil(t, err)
+
+		roles, _ := GetRolesByUser(db, u.ID)
+		assert.Len(t, roles, 1)
+		assert.Equal(t, role.ID, roles[0].ID)
+	}
+
+	// create group by user
+	{
+		restore := injectFailure(db, "group_members")
+		_, err := CreateGroupByUser(db, u.ID, "team")
+		restore()
+		assert.NotNil(t, err)
+
+		_, err = GetGroupByName(db, "team")
+		assert.NotNil(t, err)
+	}
+
+	// delete role
+	{
+		restore := injectFailure(db, "roles")
+		err := DeleteRole(db, role.ID)
+		restore()
+		assert.NotNil(t, err)
+
+		flag, _ := CheckRoleInUse(db, role.ID)
+		assert.True(t, flag)
+		ps, _ := GetPermissionsByRole(db, role.ID)
+		assert.Len(t, ps, 1)
+	}
+
+	// outer transaction
+	{
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if _, err := AddRoleWithPermissions(tx, "nested", "NESTED", []uint{p2.ID}); err != nil {
+				return err
+			}
+			return errors.New("rollback")
+		})
+		assert.NotNil(t, err)
+
+		flag, _ := CheckRoleNameExist(db, "nested")
+		assert.False(t, flag)
+	}
+
+	// delete role and permission clean up the grants and members
+	{
+		g, _ := CreateGroupByUser(db, u.ID, "team")
+		SetGroupPermission(db, g.ID, p1.ID, false)
+
+		err := DeletePermission(db, p1.ID)
+		assert.Nil(t, err)
+		flag, _ := CheckPermissionInUse(db, p1.ID)
+		assert.False(t, flag)
+		count, _ := Count[GroupPermission](db)
+		assert.Equal(t, 0, count)
+
+		err = DeleteRole(db, role.ID)
+		assert.Nil(t, err)
+		flag, _ = CheckRoleInUse(db, role.ID)
+		assert.False(t, flag)
+	}
+}
+
+func TestHasPermission(t *testing.T) {
+	db := initDB(t)
+
+	assert.Equal(t, []string{"invoice.item.approve", "invoice.item.*", "invoice.*", "*"}, permissionNameCandidates("invoice.item.approve"))
+
+	u, _ := CreateUser(db, "test@example.com", "123456")
+	approve, _ := SavePermission(db, 0, 0, "invoice.approve", "", "", false)
+	invoices, _ := SavePermission(db, 0, 0, "invoice.*", "", "", false)
+	SavePermission(db, 0, 0, "report.view", "", "", true)
+
+	pass, err := HasPermission(db, u.ID, "invoice.approve")
+	assert.Nil(t, err)
+	assert.False(t, pass)
+
+	// exact
+	accountant, _ := AddRoleWithPermissions(db, "accountant", "ACCOUNTANT", []uint{approve.ID})
+	AddRoleForUser(db, u.ID, accountant.ID)
+	pass, _ = HasPermission(db, u.ID, "invoice.approve")
+	assert.True(t, pass)
+	pass, _ = HasPermission(db, u.ID, "invoice.delete")
+	assert.False(t, pass)
+
+	// wildcard
+	manager, _ := AddRoleWithPermissions(db, "manager", "MANAGER", []uint{invoices.ID})
+	AddRoleForUser(db, u.ID, manager.ID)
+	pass, _ = HasPermission(db, u.ID, "invoice.delete")
+	assert.True(t, pass)
+	pass, _ = HasPermission(db, u.ID, "invoices.delete")
+	assert.False(t, pass)
+
+	// anonymous
+	pass, _ = HasPermission(db, u.ID, "report.view")
+	assert.True(t, pass)
+
+	// deny
+	group, _ := CreateGroupByUser(db, u.ID, "contractors")
+	SetGroupPermission(db, group.ID, approve.ID, true)
+	pass, _ = HasPermission(db, u.ID, "invoice.approve")
+	assert.False(t, pass)
+	pass, _ = HasPermission(db, u.ID, "invoice.delete")
+	assert.True(t, pass)
+}
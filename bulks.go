@@ -0,0 +1,336 @@
+package rabbit
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const bulkBatchSize = 100
+
+const (
+	BulkCreated   = "created"
+	BulkDeleted   = "deleted"
+	BulkUnchanged = "unchanged"
+	BulkNotFound  = "not_found"
+)
+
+// BulkResult is the result of one item in bulk operations, key is user id, email or role name
+type BulkResult struct {
+	Key    string `json:"key"`
+	Status string `json:"status"`
+}
+
+// existing user ids in uids
+func existingUserIDs(tx *gorm.DB, uids []uint) (map[uint]bool, error) {
+	var ids []uint
+	if err := tx.Model(&User{}).Where("id IN ?", uids).Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	exist := map[uint]bool{}
+	for _, id := range ids {
+		exist[id] = true
+	}
+	return exist, nil
+}
+
+// users of the role in uids, the expired grants not swept yet are stale, not granted
+func roleUserIDs(tx *gorm.DB, rid uint, uids []uint) (granted, stale map[uint]bool, err error) {
+	var rows []struct {
+		UserID    uint
+		ExpiresAt *time.Time
+	}
+	result := tx.Model(&UserRole{}).
+		Select("user_id, expires_at").
+		Where("role_id", rid).
+		Where("user_id IN ?", uids).
+		Scan(&rows)
+	if result.Error != nil {
+		return nil, nil, result.Error
+	}
+	now := time.Now()
+	granted, stale = map[uint]bool{}, map[uint]bool{}
+	for _, r := range rows {
+		if r.ExpiresAt == nil || r.ExpiresAt.After(now) {
+			granted[r.UserID] = true
+		} else {
+			stale[r.UserID] = true
+		}
+	}
+	return granted, stale, nil
+}
+
+// replace the stale grants of the same user and role
+func userRoleUpsert() clause.OnConflict {
+	return clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "role_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"expires_at", "granted_by"}),
+	}
+}
+
+func uniqueUserIDs(uids []uint) []uint {
+	seen := map[uint]bool{}
+	unique := make([]uint, 0, len(uids))
+	for _, uid := range uids {
+		if !seen[uid] {
+			seen[uid] = true
+			unique = append(unique, uid)
+		}
+	}
+	return unique
+}
+
+/*
+AssignRoleToUsers grant role to users in a transaction, never expires, grantedBy is recorded
+1. unknown users are not_found
+2. users already have the unexpired role are unchanged
+3. others are created in batches, the stale grants are renewed to never expire
+*/
+func AssignRoleToUsers(db *gorm.DB, rid uint, uids []uint, grantedBy uint) ([]*BulkResult, error) {
+	uids = uniqueUserIDs(uids)
+	var results []*BulkResult
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if _, err := GetRoleByID(tx, rid); err != nil {
+			return err
+		}
+		exist, err := existingUserIDs(tx, uids)
+		if err != nil {
+			return err
+		}
+		granted, _, err := roleUserIDs(tx, rid, uids)
+		if err != nil {
+			return err
+		}
+
+		results = make([]*BulkResult, 0, len(uids))
+		userRoles := make([]UserRole, 0, len(uids))
+		for _, uid := range uids {
+			result := &BulkResult{Key: strconv.Itoa(int(uid))}
+			switch {
+			// 1
+			case !exist[uid]:
+				result.Status = BulkNotFound
+			// 2
+			case granted[uid]:
+				result.Status = BulkUnchanged
+			// 3
+			default:
+				result.Status = BulkCreated
+				userRoles = append(userRoles, UserRole{UserID: uid, RoleID: rid, GrantedBy: grantedBy})
+			}
+			results = append(results, result)
+		}
+		if len(userRoles) == 0 {
+			return nil
+		}
+		return tx.Clauses(userRoleUpsert()).CreateInBatches(&userRoles, bulkBatchSize).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// RevokeRoleFromUsers revoke role from users in a transaction, users without the unexpired role are unchanged,
+// their stale grants are deleted too
+func RevokeRoleFromUsers(db *gorm.DB, rid uint, uids []uint) ([]*BulkResult, error) {
+	uids = uniqueUserIDs(uids)
+	var results []*BulkResult
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if _, err := GetRoleByID(tx, rid); err != nil {
+			return err
+		}
+		exist, err := existingUserIDs(tx, uids)
+		if err != nil {
+			return err
+		}
+		granted, stale, err := roleUserIDs(tx, rid, uids)
+		if err != nil {
+			return err
+		}
+
+		results = make([]*BulkResult, 0, len(uids))
+		revoked := make([]uint, 0, len(granted)+len(stale))
+		for _, uid := range uids {
+			result := &BulkResult{Key: strconv.Itoa(int(uid))}
+			switch {
+			case !exist[uid]:
+				result.Status = BulkNotFound
+			case !granted[uid]:
+				result.Status = BulkUnchanged
+				if stale[uid] {
+					revoked = append(revoked, uid)
+				}
+			default:
+				result.Status = BulkDeleted
+				revoked = append(revoked, uid)
+			}
+			results = append(results, result)
+		}
+		if len(revoked) == 0 {
+			return nil
+		}
+		return tx.Where("role_id = ? AND user_id IN ?", rid, revoked).Delete(&UserRole{}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+/*
+SyncGroupMembers make the members of group exactly the users of emails, in a transaction,
+emails are trimmed and lowercased as GetUserByEmail
+1. unknown emails are not_found
+2. members in emails are unchanged, others are created
+3. members not in emails are deleted
+*/
+func SyncGroupMembers(db *gorm.DB, gid uint, emails []string) ([]*BulkResult, error) {
+	normalized := make([]string, 0, len(emails))
+	for _, email := range emails {
+		normalized = append(normalized, strings.ToLower(strings.TrimSpace(email)))
+	}
+	emails = normalized
+
+	var results []*BulkResult
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if _, err := GetGroupByID(tx, gid); err != nil {
+			return err
+		}
+
+		var users []*User
+		if err := tx.Where("email IN ?", emails).Find(&users).Error; err != nil {
+			return err
+		}
+		byEmail := map[string]*User{}
+		for _, u := range users {
+			byEmail[u.Email] = u
+		}
+
+		var members []*User
+		result := tx.Where("id IN (?)", tx.Model(&GroupMember{}).Select("user_id").Where("group_id", gid)).
+			Order("id").
+			Find(&members)
+		if result.Error != nil {
+			return result.Error
+		}
+		isMember := map[uint]bool{}
+		for _, m := range members {
+			isMember[m.ID] = true
+		}
+
+		seen := map[string]bool{}
+		keep := map[uint]bool{}
+		var created []GroupMember
+		for _, email := range emails {
+			if seen[email] {
+				continue
+			}
+			seen[email] = true
+
+			result := &BulkResult{Key: email}
+			u, ok := byEmail[email]
+			switch {
+			// 1
+			case !ok:
+				result.Status = BulkNotFound
+			// 2
+			case isMember[u.ID]:
+				result.Status = BulkUnchanged
+				keep[u.ID] = true
+			default:
+				result.Status = BulkCreated
+				keep[u.ID] = true
+				created = append(created, GroupMember{UserID: u.ID, GroupID: gid})
+			}
+			results = append(results, result)
+		}
+
+		// 3
+		var removed []uint
+		for _, m := range members {
+			if !keep[m.ID] {
+				removed = append(removed, m.ID)
+				results = append(results, &BulkResult{Key: m.Email, Status: BulkDeleted})
+			}
+		}
+
+		if len(removed) > 0 {
+			if err := tx.Where("group_id = ? AND user_id IN ?", gid, removed).Delete(&GroupMember{}).Error; err != nil {
+				return err
+			}
+		}
+		if len(created) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(&created, bulkBatchSize).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// CopyRolesForUser grant the unexpired roles of user from to user to, keep the expiration,
+// the unexpired roles user to already has are unchanged
+func CopyRolesForUser(db *gorm.DB, from, to uint, grantedBy uint) ([]*BulkResult, error) {
+	var results []*BulkResult
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, uid := range []uint{from, to} {
+			if _, err := GetByID[User](tx, uid); err != nil {
+				return err
+			}
+		}
+
+		var grants []struct {
+			RoleID    uint
+			Name      string
+			ExpiresAt *time.Time
+		}
+		result := tx.Table("? AS user_roles", tableOf(tx, &UserRole{})).
+			Select("user_roles.role_id, roles.name, user_roles.expires_at").
+			Joins("JOIN ? AS roles ON roles.id = user_roles.role_id", tableOf(tx, &Role{})).
+			Where("user_roles.user_id", from).
+			Where("user_roles.expires_at IS NULL OR user_roles.expires_at > ?", time.Now().UTC()).
+			Order("roles.name").
+			Scan(&grants)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		var current []uint
+		result = tx.Model(&UserRole{}).
+			Where("user_id", to).
+			Where("expires_at IS NULL OR expires_at > ?", time.Now().UTC()).
+			Pluck("role_id", &current)
+		if err := result.Error; err != nil {
+			return err
+		}
+		has := map[uint]bool{}
+		for _, rid := range current {
+			has[rid] = true
+		}
+
+		results = make([]*BulkResult, 0, len(grants))
+		var userRoles []UserRole
+		for _, g := range grants {
+			if has[g.RoleID] {
+				results = append(results, &BulkResult{Key: g.Name, Status: BulkUnchanged})
+				continue
+			}
+			results = append(results, &BulkResult{Key: g.Name, Status: BulkCreated})
+			userRoles = append(userRoles, UserRole{UserID: to, RoleID: g.RoleID, ExpiresAt: g.ExpiresAt, GrantedBy: grantedBy})
+		}
+		if len(userRoles) == 0 {
+			return nil
+		}
+		return tx.Clauses(userRoleUpsert()).CreateInBatches(&userRoles, bulkBatchSize).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
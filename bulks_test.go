@@ -0,0 +1,169 @@
+package rabbit
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func bulkStatus(results []*BulkResult) map[string]string {
+	status := map[string]string{}
+	for _, r := range results {
+		status[r.Key] = r.Status
+	}
+	return status
+}
+
+func TestAssignAndRevokeRole(t *testing.T) {
+	db := initDB(t)
+	bob, _ := CreateUser(db, "bob@example.org", "123456")
+	alice, _ := CreateUser(db, "alice@example.org", "123456")
+	role, _ := CreateRole(db, "viewer", "VIEWER")
+	AddRoleForUser(db, bob.ID, role.ID)
+
+	bobKey, aliceKey := strconv.Itoa(int(bob.ID)), strconv.Itoa(int(alice.ID))
+
+	results, err := AssignRoleToUsers(db, role.ID, []uint{bob.ID, alice.ID, alice.ID, 999}, 0)
+	assert.Nil(t, err)
+	assert.Len(t, results, 3)
+	assert.Equal(t, map[string]string{bobKey: BulkUnchanged, aliceKey: BulkCreated, "999": BulkNotFound}, bulkStatus(results))
+
+	users, _ := GetUsersByRole(db, role.ID)
+	assert.Len(t, users, 2)
+
+	_, err = AssignRoleToUsers(db, 999, []uint{bob.ID}, 0)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	// rollback
+	{
+		carol, _ := CreateUser(db, "carol@example.org", "123456")
+		restore := injectFailure(db, "user_roles")
+		_, err := AssignRoleToUsers(db, role.ID, []uint{carol.ID}, 0)
+		restore()
+		assert.NotNil(t, err)
+		roles, _ := GetRolesByUser(db, carol.ID)
+		assert.Len(t, roles, 0)
+	}
+
+	results, err = RevokeRoleFromUsers(db, role.ID, []uint{alice.ID, 999})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{aliceKey: BulkDeleted, "999": BulkNotFound}, bulkStatus(results))
+
+	results, err = RevokeRoleFromUsers(db, role.ID, []uint{alice.ID})
+	assert.Nil(t, err)
+	assert.Equal(t, BulkUnchanged, results[0].Status)
+
+	roles, _ := GetRolesByUser(db, bob.ID)
+	assert.Len(t, roles, 1)
+}
+
+func TestBulkRoleWithExpiredGrants(t *testing.T) {
+	db := initDB(t)
+	bob, _ := CreateUser(db, "bob@example.org", "123456")
+	alice, _ := CreateUser(db, "alice@example.org", "123456")
+	role, _ := CreateRole(db, "oncall", "ONCALL")
+	bobKey := strconv.Itoa(int(bob.ID))
+
+	// the expired grant is renewed to never expire
+	AddRoleForUserUntil(db, bob.ID, role.ID, time.Now().Add(-time.Hour), 0)
+	results, err := AssignRoleToUsers(db, role.ID, []uint{bob.ID}, alice.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{bobKey: BulkCreated}, bulkStatus(results))
+
+	var ur UserRole
+	err = db.Where("user_id = ? AND role_id = ?", bob.ID, role.ID).Take(&ur).Error
+	assert.Nil(t, err)
+	assert.Nil(t, ur.ExpiresAt)
+	assert.Equal(t, alice.ID, ur.GrantedBy)
+
+	// the expired grant is not held
+	db.Model(&UserRole{}).Where("user_id", bob.ID).Update("expires_at", time.Now().Add(-time.Hour).UTC())
+	results, err = RevokeRoleFromUsers(db, role.ID, []uint{bob.ID})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{bobKey: BulkUnchanged}, bulkStatus(results))
+
+	var count int64
+	db.Model(&UserRole{}).Where("user_id", bob.ID).Count(&count)
+	assert.Equal(t, int64(0), count)
+
+	// the expired grant of target user is replaced by the copied one
+	AddRoleForUser(db, alice.ID, role.ID)
+	AddRoleForUserUntil(db, bob.ID, role.ID, time.Now().Add(-time.Hour), 0)
+	results, err = CopyRolesForUser(db, alice.ID, bob.ID, alice.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"oncall": BulkCreated}, bulkStatus(results))
+
+	roles, _ := GetRolesByUser(db, bob.ID)
+	assert.Len(t, roles, 1)
+	ur = UserRole{}
+	db.Where("user_id = ? AND role_id = ?", bob.ID, role.ID).Take(&ur)
+	assert.Nil(t, ur.ExpiresAt)
+	assert.Equal(t, alice.ID, ur.GrantedBy)
+}
+
+func TestSyncGroupMembers(t *testing.T) {
+	db := initDB(t)
+	bob, _ := CreateUser(db, "bob@example.org", "123456")
+	CreateUser(db, "alice@example.org", "123456")
+	CreateUser(db, "carol@example.org", "123456")
+	group, _ := CreateGroupByUser(db, bob.ID, "dev")
+
+	results, err := SyncGroupMembers(db, group.ID, []string{"alice@example.org", "carol@example.org", "dave@example.org"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"alice@example.org": BulkCreated,
+		"carol@example.org": BulkCreated,
+		"dave@example.org":  BulkNotFound,
+		"bob@example.org":   BulkDeleted,
+	}, bulkStatus(results))
+
+	users, _ := GetUsersByGroup(db, group.ID)
+	assert.Len(t, users, 2)
+
+	results, err = SyncGroupMembers(db, group.ID, []string{"alice@example.org", " Carol@Example.org "})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"alice@example.org": BulkUnchanged,
+		"carol@example.org": BulkUnchanged,
+	}, bulkStatus(results))
+
+	results, err = SyncGroupMembers(db, group.ID, []string{"alice@example.org"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"alice@example.org": BulkUnchanged,
+		"carol@example.org": BulkDeleted,
+	}, bulkStatus(results))
+
+	_, err = SyncGroupMembers(db, 999, nil)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+}
+
+func TestCopyRolesForUser(t *testing.T) {
+	db := initDB(t)
+	bob, _ := CreateUser(db, "bob@example.org", "123456")
+	alice, _ := CreateUser(db, "alice@example.org", "123456")
+	viewer, _ := CreateRole(db, "viewer", "VIEWER")
+	oncall, _ := CreateRole(db, "oncall", "ONCALL")
+	expired, _ := CreateRole(db, "expired", "EXPIRED")
+
+	AddRoleForUser(db, bob.ID, viewer.ID)
+	AddRoleForUserUntil(db, bob.ID, oncall.ID, time.Now().Add(time.Hour), 0)
+	AddRoleForUserUntil(db, bob.ID, expired.ID, time.Now().Add(-time.Hour), 0)
+	AddRoleForUser(db, alice.ID, viewer.ID)
+
+	results, err := CopyRolesForUser(db, bob.ID, alice.ID, bob.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"viewer": BulkUnchanged, "oncall": BulkCreated}, bulkStatus(results))
+
+	var ur UserRole
+	err = db.Where("user_id = ? AND role_id = ?", alice.ID, oncall.ID).Take(&ur).Error
+	assert.Nil(t, err)
+	assert.NotNil(t, ur.ExpiresAt)
+	assert.Equal(t, bob.ID, ur.GrantedBy)
+
+	_, err = CopyRolesForUser(db, bob.ID, 999, 0)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+}
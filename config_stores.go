@@ -0,0 +1,177 @@
+package rabbit
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const configStorePluginName = "rabbit:config_store"
+
+/*
+ConfigStore cache all Config rows in memory, used by GetValue and SetValue after EnableConfigCache
+1. reads are lock-free, SetValue replace the values copy-on-write
+2. Poll reload the values if the configs are changed by other replicas
+3. SigConfigChanged is emitted for each changed key
+*/
+type ConfigStore struct {
+	db     *gorm.DB
+	values atomic.Pointer[map[string]string]
+
+	lock      sync.Mutex
+	updatedAt time.Time
+	count     int64
+}
+
+func NewConfigStore(db *gorm.DB) (*ConfigStore, error) {
+	s := &ConfigStore{db: db}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// EnableConfigCache register a ConfigStore to db, GetValue and SetValue use it after
+func EnableConfigCache(db *gorm.DB) (*ConfigStore, error) {
+	s, err := NewConfigStore(db)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Use(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func getConfigStore(db *gorm.DB) *ConfigStore {
+	if plugin, ok := db.Config.Plugins[configStorePluginName]; ok {
+		return plugin.(*ConfigStore)
+	}
+	return nil
+}
+
+// Name implements gorm.Plugin
+func (s *ConfigStore) Name() string {
+	return configStorePluginName
+}
+
+// Initialize implements gorm.Plugin
+func (s *ConfigStore) Initialize(db *gorm.DB) error {
+	return nil
+}
+
+func (s *ConfigStore) Get(key string) (string, bool) {
+	values := s.values.Load()
+	if values == nil {
+		return "", false
+	}
+	v, ok := (*values)[key]
+	return v, ok
+}
+
+func (s *ConfigStore) set(key, value string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	old := s.values.Load()
+	values := make(map[string]string, len(*old)+1)
+	for k, v := range *old {
+		values[k] = v
+	}
+	values[key] = value
+	s.values.Store(&values)
+}
+
+// Reload load all Config rows, emit SigConfigChanged for the keys changed since last load,
+// the signal is emitted after unlock, so the listeners can call SetValue
+func (s *ConfigStore) Reload() error {
+	changes, err := s.reload()
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		Sig().Emit(SigConfigChanged, c.key, c.old, c.new)
+	}
+	return nil
+}
+
+func (s *ConfigStore) reload() ([]configChange, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var configs []Config
+	if err := s.db.Find(&configs).Error; err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(configs))
+	for _, c := range configs {
+		values[c.Key] = c.Value
+		if c.UpdatedAt.After(s.updatedAt) {
+			s.updatedAt = c.UpdatedAt
+		}
+	}
+	s.count = int64(len(configs))
+
+	old := s.values.Swap(&values)
+	if old == nil {
+		return nil, nil
+	}
+	var changes []configChange
+	for k, v := range values {
+		if ov := (*old)[k]; ov != v {
+			changes = append(changes, configChange{key: k, old: ov, new: v})
+		}
+	}
+	return changes, nil
+}
+
+// Poll reload if the latest updated_at or the count of configs is changed
+func (s *ConfigStore) Poll() error {
+	var latest Config
+	result := s.db.Select("updated_at").
+		Where("updated_at IS NOT NULL").
+		Order("updated_at DESC").
+		Limit(1).
+		Find(&latest)
+	if result.Error != nil {
+		return result.Error
+	}
+	var count int64
+	if err := s.db.Model(&Config{}).Count(&count).Error; err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	changed := !latest.UpdatedAt.Equal(s.updatedAt) || count != s.count
+	s.lock.Unlock()
+	if !changed {
+		return nil
+	}
+	return s.Reload()
+}
+
+// StartPolling run Poll every interval in background, until stop is called
+func (s *ConfigStore) StartPolling(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := s.Poll(); err != nil {
+					Warningln("poll configs fail:", err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
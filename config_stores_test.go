@@ -0,0 +1,181 @@
+package rabbit
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestConfigStore(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "configs.db")
+	db, _ := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	db.AutoMigrate(&Config{})
+	SetValue(db, "cached_key", "1")
+
+	store, err := EnableConfigCache(db)
+	assert.Nil(t, err)
+	_, err = EnableConfigCache(db)
+	assert.NotNil(t, err)
+
+	var changes [][]string
+	Sig().Connect(SigConfigChanged, func(sender any, params ...any) {
+		changes = append(changes, []string{sender.(string), params[0].(string), params[1].(string)})
+	})
+	defer Sig().DisConnect(SigConfigChanged)
+
+	// served from memory
+	db.Model(&Config{}).Where("key", "CACHED_KEY").UpdateColumn("value", "2")
+	assert.Equal(t, "1", GetValue(db, "cached_key"))
+
+	// invalidated by SetValue
+	SetValue(db, "cached_key", "3")
+	assert.Equal(t, "3", GetValue(db, "cached_key"))
+	SetValue(db, "new_key", "true")
+	assert.True(t, GetBoolValue(db, "new_key"))
+	assert.Equal(t, [][]string{{"CACHED_KEY", "2", "3"}, {"NEW_KEY", "", "true"}}, changes)
+
+	// poll the changes of other replica
+	other, _ := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	time.Sleep(time.Millisecond)
+	SetValue(other, "cached_key", "4")
+	SetValue(other, "remote_key", "5")
+	assert.Equal(t, "3", GetValue(db, "cached_key"))
+
+	changes = nil
+	err = store.Poll()
+	assert.Nil(t, err)
+	assert.Equal(t, "4", GetValue(db, "cached_key"))
+	v, ok := store.Get("REMOTE_KEY")
+	assert.True(t, ok)
+	assert.Equal(t, "5", v)
+	assert.ElementsMatch(t, [][]string{{"CACHED_KEY", "3", "4"}, {"REMOTE_KEY", "", "5"}}, changes)
+
+	// nothing changed
+	changes = nil
+	err = store.Poll()
+	assert.Nil(t, err)
+	assert.Len(t, changes, 0)
+}
+
+func newTestConfigStore(t *testing.T) (*gorm.DB, *gorm.DB, *ConfigStore) {
+	dsn := filepath.Join(t.TempDir(), "configs.db")
+	db, _ := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	db.AutoMigrate(&Config{}, &ConfigHistory{})
+	other, _ := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+
+	store, err := EnableConfigCache(db)
+	assert.Nil(t, err)
+	return db, other, store
+}
+
+func TestConfigStoreReload(t *testing.T) {
+	db, other, store := newTestConfigStore(t)
+	SetValue(db, "reload_key", "1")
+
+	var changes [][]string
+	Sig().Connect(SigConfigChanged, func(sender any, params ...any) {
+		changes = append(changes, []string{sender.(string), params[0].(string), params[1].(string)})
+	})
+	defer Sig().DisConnect(SigConfigChanged)
+
+	// Reload without Poll checks
+	other.Model(&Config{}).Where("key", "RELOAD_KEY").UpdateColumn("value", "2")
+	err := store.Reload()
+	assert.Nil(t, err)
+	assert.Equal(t, "2", GetValue(db, "reload_key"))
+	assert.Equal(t, [][]string{{"RELOAD_KEY", "1", "2"}}, changes)
+
+	changes = nil
+	err = store.Reload()
+	assert.Nil(t, err)
+	assert.Len(t, changes, 0)
+}
+
+func TestConfigStoreSignalListener(t *testing.T) {
+	db, other, store := newTestConfigStore(t)
+
+	// the listener writes configs while Poll emits
+	Sig().Connect(SigConfigChanged, func(sender any, params ...any) {
+		if sender.(string) == "SOURCE_KEY" {
+			SetValue(db, "derived_key", params[1].(string)+"-derived")
+		}
+	})
+	defer Sig().DisConnect(SigConfigChanged)
+
+	time.Sleep(time.Millisecond)
+	SetValue(other, "source_key", "v1")
+
+	done := make(chan error, 1)
+	go func() { done <- store.Poll() }()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Poll deadlocked")
+	}
+	assert.Equal(t, "v1", GetValue(db, "source_key"))
+	assert.Equal(t, "v1-derived", GetValue(db, "derived_key"))
+}
+
+func TestConfigStoreTransaction(t *testing.T) {
+	db, _, store := newTestConfigStore(t)
+	SetValue(db, "tx_key", "1")
+
+	var changes []string
+	Sig().Connect(SigConfigChanged, func(sender any, params ...any) {
+		changes = append(changes, sender.(string))
+	})
+	defer Sig().DisConnect(SigConfigChanged)
+
+	// rollback of UpdateValues
+	restore := injectFailure(db, "config_histories")
+	_, err := UpdateValues(db, map[string]string{"tx_key": "2"}, 0)
+	restore()
+	assert.NotNil(t, err)
+	assert.Equal(t, "1", GetValue(db, "tx_key"))
+	assert.Len(t, changes, 0)
+
+	// applied after commit
+	_, err = UpdateValues(db, map[string]string{"tx_key": "3"}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "3", GetValue(db, "tx_key"))
+	assert.Equal(t, []string{"TX_KEY"}, changes)
+
+	// rollback of other transaction
+	changes = nil
+	err = db.Transaction(func(tx *gorm.DB) error {
+		SetValue(tx, "tx_key", "4")
+		assert.Equal(t, "4", GetValue(tx, "tx_key"))
+		return errors.New("mock error")
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, "3", GetValue(db, "tx_key"))
+	assert.Len(t, changes, 0)
+
+	// the commit of other transaction is picked up by Poll
+	time.Sleep(time.Millisecond)
+	db.Transaction(func(tx *gorm.DB) error {
+		return SetValue(tx, "tx_key", "5")
+	})
+	err = store.Poll()
+	assert.Nil(t, err)
+	assert.Equal(t, "5", GetValue(db, "tx_key"))
+	assert.Equal(t, []string{"TX_KEY"}, changes)
+
+	// the commit of ConfigTransaction is applied without Poll
+	changes = nil
+	err = ConfigTransaction(db, func(tx *gorm.DB) error {
+		if err := SetValue(tx, "tx_key", "6"); err != nil {
+			return err
+		}
+		return tx.Create(&ConfigHistory{Key: "TX_KEY", OldValue: "5", NewValue: "6"}).Error
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "6", GetValue(db, "tx_key"))
+	assert.Equal(t, []string{"TX_KEY"}, changes)
+}
@@ -1,66 +1,111 @@
 package rabbit
 
 import (
-	"os"
+	"context"
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
 	"gorm.io/gorm"
 )
 
-func GetEnv(key string) string {
-	v, _ := LookupEnv(key)
-	return v
+// SigConfigChanged: key string, old string, new string
+const SigConfigChanged = "config.changed"
+
+// SetValue set the value of key, the value of registered setting is validated
+func SetValue(db *gorm.DB, key, value string) error {
+	key = strings.ToUpper(key)
+
+	if err := ValidateSetting(key, value); err != nil {
+		return err
+	}
+	return writeValue(db, key, value, false)
+}
+
+// write the value of key, the secret config can only be written by SetSecretValue
+func writeValue(db *gorm.DB, key, value string, secret bool) error {
+	var v Config
+	var err error
+	result := db.Where("key", key).Take(&v)
+	if result.Error != nil {
+		newV := &Config{
+			Key:    key,
+			Value:  value,
+			Secret: secret,
+		}
+		err = db.Create(&newV).Error
+	} else if v.Secret && !secret {
+		err = fmt.Errorf("%w: %s", ErrSecretConfig, key)
+	} else {
+		err = db.Model(&Config{}).Where("key", key).Updates(map[string]any{"value": value, "secret": secret}).Error
+	}
+	if err != nil {
+		return err
+	}
+
+	applyConfigChange(db, configChange{key: key, old: v.Value, new: value})
+	return nil
 }
 
+type configChange struct {
+	key, old, new string
+}
+
+type configChangesKey struct{}
+
 /*
-1. Check .env file
-2. Check environment variables
+update the cache of ConfigStore and emit SigConfigChanged for the committed change
+1. in ConfigTransaction, applied after commit
+2. in other transaction, the commit is unknown, left to ConfigStore.Poll, use ConfigTransaction instead
 */
-func LookupEnv(key string) (string, bool) {
+func applyConfigChange(db *gorm.DB, change configChange) {
 	// 1
-	data, err := os.ReadFile(".env")
-	if err != nil {
-		// 2
-		return os.LookupEnv(key)
+	if pending, ok := db.Statement.Context.Value(configChangesKey{}).(*[]configChange); ok {
+		*pending = append(*pending, change)
+		return
 	}
-	lines := strings.Split(string(data), "\n")
-	for i := 0; i < len(lines); i++ {
-		v := strings.TrimSpace(lines[i])
-		if v == "" || v[0] == '#' {
-			continue
-		}
-		if !strings.Contains(v, "=") {
-			continue
-		}
-		vs := strings.SplitN(v, "=", 2)
-		if strings.EqualFold(strings.TrimSpace(vs[0]), key) {
-			return strings.TrimSpace(vs[1]), true
-		}
+	// 2
+	if inTransaction(db) {
+		return
 	}
 
-	return "", false
+	if store := getConfigStore(db); store != nil {
+		store.set(change.key, change.new)
+	}
+	if change.old != change.new {
+		Sig().Emit(SigConfigChanged, change.key, change.old, change.new)
+	}
 }
 
-func SetValue(db *gorm.DB, key, value string) {
-	key = strings.ToUpper(key)
+func inTransaction(db *gorm.DB) bool {
+	_, ok := db.Statement.ConnPool.(gorm.TxCommitter)
+	return ok
+}
 
-	var v Config
-	result := db.Where("key", key).Take(&v)
-	if result.Error != nil {
-		newV := &Config{
-			Key:   key,
-			Value: value,
-		}
-		db.Create(&newV)
-		return
+// ConfigTransaction run fn in a transaction, the config changes are applied after commit, dropped on rollback,
+// use it instead of db.Transaction to update configs with other tables
+func ConfigTransaction(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	pending := []configChange{}
+	ctx := context.WithValue(db.Statement.Context, configChangesKey{}, &pending)
+	if err := db.WithContext(ctx).Transaction(fn); err != nil {
+		return err
 	}
-	db.Model(&Config{}).Where("key", key).UpdateColumn("value", value)
+	for _, change := range pending {
+		applyConfigChange(db, change)
+	}
+	return nil
 }
 
 func GetValue(db *gorm.DB, key string) string {
 	key = strings.ToUpper(key)
 
+	// the cache is not updated before commit, read the uncommitted value in transaction
+	if store := getConfigStore(db); store != nil && !inTransaction(db) {
+		v, _ := store.Get(key)
+		return v
+	}
+
 	var v Config
 	result := db.Where("key", key).Take(&v)
 	if result.Error != nil {
@@ -70,7 +115,18 @@ func GetValue(db *gorm.DB, key string) string {
 	return v.Value
 }
 
+// GetIntValue is the legacy helper, return default_value with a warning if the value is empty or invalid,
+// the registered setting is read by GetSetting, use GetSetting to handle the invalid value
 func GetIntValue(db *gorm.DB, key string, default_value int) int {
+	if _, ok := GetRegisteredSetting(key); ok {
+		val, err := GetSetting[int](db, key)
+		if err != nil {
+			Warningln(err)
+			return default_value
+		}
+		return val
+	}
+
 	v := GetValue(db, key)
 
 	if v == "" {
@@ -79,13 +135,25 @@ func GetIntValue(db *gorm.DB, key string, default_value int) int {
 
 	val, err := strconv.ParseInt(v, 10, 64)
 	if err != nil {
+		Warningf("config %s is not int: %s", key, v)
 		return default_value
 	}
 
 	return int(val)
 }
 
+// GetBoolValue is the legacy helper, return false with a warning if the value is empty or invalid,
+// the registered setting is read by GetSetting, use GetSetting to handle the invalid value
 func GetBoolValue(db *gorm.DB, key string) bool {
+	if _, ok := GetRegisteredSetting(key); ok {
+		val, err := GetSetting[bool](db, key)
+		if err != nil {
+			Warningln(err)
+			return false
+		}
+		return val
+	}
+
 	v := GetValue(db, key)
 
 	if v == "" {
@@ -94,15 +162,225 @@ func GetBoolValue(db *gorm.DB, key string) bool {
 
 	val, err := strconv.ParseBool(v)
 	if err != nil {
+		Warningf("config %s is not bool: %s", key, v)
 		return false
 	}
 
 	return val
 }
 
-// CheckValue check if key exists, if not, set default_value
-func CheckValue(db *gorm.DB, key, default_value string) {
+// CheckValue check if key exists, if not, set default_value, the error of SetValue is returned
+func CheckValue(db *gorm.DB, key, default_value string) error {
 	if GetValue(db, key) == "" {
-		SetValue(db, key, default_value)
+		return SetValue(db, key, default_value)
+	}
+	return nil
+}
+
+// ConfigItem is the Config with the type and default of registered setting
+type ConfigItem struct {
+	Config
+	Type    SettingType `json:"type,omitempty"`
+	Default string      `json:"default,omitempty"`
+}
+
+// ListConfigs return all configs sorted by key, the registered settings not in db are listed with default value
+func ListConfigs(db *gorm.DB) ([]*ConfigItem, error) {
+	var configs []Config
+	if err := db.Order("id").Find(&configs).Error; err != nil {
+		return nil, err
+	}
+
+	items := map[string]*ConfigItem{}
+	for _, c := range configs {
+		if c.Secret {
+			c.Value = RedactedValue
+		}
+		items[c.Key] = &ConfigItem{Config: c}
+	}
+	for _, s := range ListSettings() {
+		item, ok := items[s.Key]
+		if !ok {
+			item = &ConfigItem{Config: Config{Key: s.Key, Value: s.Default, Desc: s.Desc}}
+			items[s.Key] = item
+		}
+		item.Type, item.Default = s.Type, s.Default
+	}
+
+	result := make([]*ConfigItem, 0, len(items))
+	for _, item := range items {
+		result = append(result, item)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result, nil
+}
+
+/*
+UpdateValues set the values in a transaction, record the changes to ConfigHistory
+1. all values are validated before writing
+2. unchanged values are not recorded, RedactedValue of secret is unchanged
+3. the cache of ConfigStore and SigConfigChanged are applied after commit
+*/
+func UpdateValues(db *gorm.DB, values map[string]string, actorID uint) ([]*ConfigHistory, error) {
+	secret, err := secretKeys(db, values)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(values))
+	for key, value := range values {
+		// 2, posted back from ListConfigs
+		if secret[strings.ToUpper(key)] && value == RedactedValue {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// 1
+	if err := validateValues(keys, values, secret); err != nil {
+		return nil, err
+	}
+
+	var changes []*ConfigHistory
+	err = ConfigTransaction(db, func(tx *gorm.DB) error {
+		for _, key := range keys {
+			change, err := updateValue(tx, strings.ToUpper(key), values[key], actorID)
+			if err != nil {
+				return err
+			}
+			if change != nil {
+				changes = append(changes, change)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// the secret keys in values, uppercase
+func secretKeys(db *gorm.DB, values map[string]string) (map[string]bool, error) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, strings.ToUpper(key))
+	}
+	secret := map[string]bool{}
+	if len(keys) == 0 {
+		return secret, nil
+	}
+	var found []string
+	if err := db.Model(&Config{}).Where("key", keys).Where("secret", true).Pluck("key", &found).Error; err != nil {
+		return nil, err
+	}
+	for _, key := range found {
+		secret[key] = true
+	}
+	return secret, nil
+}
+
+// the encrypted values of secret, restored from history, are validated by the plaintext
+func validateValues(keys []string, values map[string]string, secret map[string]bool) error {
+	for _, key := range keys {
+		value := values[key]
+		if secret[strings.ToUpper(key)] && isSecretValue(value) {
+			plain, err := DecryptSecret(strings.ToUpper(key), value)
+			if err != nil {
+				return fmt.Errorf("%w %s: %w", ErrInvalidSetting, key, err)
+			}
+			value = plain
+		}
+		if err := ValidateSetting(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func updateValue(tx *gorm.DB, key, value string, actorID uint) (*ConfigHistory, error) {
+	var old Config
+	if err := tx.Where("key", key).Limit(1).Find(&old).Error; err != nil {
+		return nil, err
+	}
+	// 2
+	if old.ID != 0 && old.Value == value {
+		return nil, nil
+	}
+	var err error
+	switch {
+	case !old.Secret:
+		err = SetValue(tx, key, value)
+	case isSecretValue(value):
+		// rollback to the encrypted value in history
+		err = writeValue(tx, key, value, true)
+	default:
+		err = SetSecretValue(tx, key, value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if old.Secret {
+		value = GetValue(tx, key)
+	}
+
+	change := &ConfigHistory{Key: key, OldValue: old.Value, NewValue: value, ActorID: actorID}
+	if err := tx.Create(change).Error; err != nil {
+		return nil, err
+	}
+	if old.Secret {
+		redactHistory(change)
+	}
+	return change, nil
+}
+
+// GetConfigHistory return the changes of key, latest first, the values of secret are redacted
+func GetConfigHistory(db *gorm.DB, key string, limit int) ([]*ConfigHistory, error) {
+	key = strings.ToUpper(key)
+
+	var items []*ConfigHistory
+	result := db.Where("key", key).Order("id DESC").Limit(limit).Find(&items)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	var secret int64
+	if err := db.Model(&Config{}).Where("key", key).Where("secret", true).Count(&secret).Error; err != nil {
+		return nil, err
+	}
+	if secret > 0 {
+		redactHistory(items...)
+	}
+	return items, nil
+}
+
+func redactHistory(items ...*ConfigHistory) {
+	for _, h := range items {
+		h.OldValue, h.NewValue = RedactedValue, RedactedValue
+	}
+}
+
+// RollbackValue restore the value before the change historyID of key, 0 means the latest change,
+// the rollback is recorded as a new change
+func RollbackValue(db *gorm.DB, key string, historyID uint, actorID uint) (*ConfigHistory, error) {
+	key = strings.ToUpper(key)
+
+	var h ConfigHistory
+	query := db.Where("key", key)
+	if historyID != 0 {
+		query = query.Where("id", historyID)
+	}
+	if err := query.Order("id DESC").Take(&h).Error; err != nil {
+		return nil, err
+	}
+
+	changes, err := UpdateValues(db, map[string]string{key: h.OldValue}, actorID)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		return nil, nil
 	}
+	return changes[0], nil
 }
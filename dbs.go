@@ -1,63 +1,181 @@
 package rabbit
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
+	"gorm.io/driver/sqlserver"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
 )
 
+// DatabaseOptions of InitDatabaseWithOptions, the zero fields are read from env by LoadSettings
+type DatabaseOptions struct {
+	Driver string `env:"DB_DRIVER"`
+	DSN    string `env:"DSN"`
+
+	// pool, zero is the default of database/sql
+	MaxOpenConns    int           `env:"DB_MAX_OPEN_CONNS"`
+	MaxIdleConns    int           `env:"DB_MAX_IDLE_CONNS"`
+	ConnMaxLifetime time.Duration `env:"DB_CONN_MAX_LIFETIME"`
+
+	LogWriter     io.Writer     // default is os.Stdout
+	LogLevel      string        `env:"DB_LOG_LEVEL" default:"warn"` // silent, error, warn, info
+	SlowThreshold time.Duration `env:"DB_SLOW_THRESHOLD" default:"1s"`
+
+	TablePrefix    string       `env:"DB_TABLE_PREFIX"`
+	NamingStrategy schema.Namer // overrides TablePrefix
+	PrepareStmt    *bool        `env:"DB_PREPARE_STMT"` // nil is read from env, false disables it explicitly
+}
+
+var dbLogLevels = map[string]logger.LogLevel{
+	"silent": logger.Silent,
+	"error":  logger.Error,
+	"warn":   logger.Warn,
+	"info":   logger.Info,
+}
+
+// InitDatabase open db by driver and dsn, or DB_DRIVER and DSN in env if empty, panic on error
 func InitDatabase(driver, dsn string, logWrite io.Writer) *gorm.DB {
-	if driver == "" {
-		driver = GetEnv(ENV_DB_DRIVER)
-	}
-	if dsn == "" {
-		dsn = GetEnv(ENV_DSN)
+	db, err := InitDatabaseWithOptions(DatabaseOptions{
+		Driver:    driver,
+		DSN:       dsn,
+		LogWriter: logWrite,
+	})
+	if err != nil {
+		panic(err)
 	}
+	return db
+}
 
-	var l logger.Interface
-	if logWrite == nil {
-		logWrite = os.Stdout
+/*
+InitDatabaseWithOptions open db and return the error, so callers can retry
+1. zero fields of opts are read from env
+2. logger with level and slow threshold
+3. naming strategy and prepared statements
+4. connection pool
+*/
+func InitDatabaseWithOptions(opts DatabaseOptions) (*gorm.DB, error) {
+	// 1
+	var env DatabaseOptions
+	if err := LoadSettings(nil, &env); err != nil {
+		return nil, err
+	}
+	if opts.Driver == "" {
+		opts.Driver = env.Driver
+	}
+	if opts.DSN == "" {
+		opts.DSN = env.DSN
+	}
+	if opts.MaxOpenConns == 0 {
+		opts.MaxOpenConns = env.MaxOpenConns
+	}
+	if opts.MaxIdleConns == 0 {
+		opts.MaxIdleConns = env.MaxIdleConns
+	}
+	if opts.ConnMaxLifetime == 0 {
+		opts.ConnMaxLifetime = env.ConnMaxLifetime
+	}
+	if opts.LogWriter == nil {
+		opts.LogWriter = os.Stdout
+	}
+	if opts.LogLevel == "" {
+		opts.LogLevel = env.LogLevel
+	}
+	if opts.SlowThreshold == 0 {
+		opts.SlowThreshold = env.SlowThreshold
+	}
+	if opts.TablePrefix == "" {
+		opts.TablePrefix = env.TablePrefix
+	}
+	if opts.PrepareStmt == nil {
+		opts.PrepareStmt = env.PrepareStmt
 	}
 
-	l = logger.New(
-		log.New(logWrite, "\r\n", log.LstdFlags), // io writer
+	// 2
+	level, ok := dbLogLevels[strings.ToLower(opts.LogLevel)]
+	if !ok {
+		return nil, fmt.Errorf("unknown database log level: %s", opts.LogLevel)
+	}
+	l := logger.New(
+		log.New(opts.LogWriter, "\r\n", log.LstdFlags), // io writer
 		logger.Config{
-			SlowThreshold:             time.Second, // Slow SQL threshold
-			LogLevel:                  logger.Warn, // Log level
-			IgnoreRecordNotFoundError: true,        // Ignore ErrRecordNotFound error for logger
-			Colorful:                  false,       // Disable color
+			SlowThreshold:             opts.SlowThreshold, // Slow SQL threshold
+			LogLevel:                  level,              // Log level
+			IgnoreRecordNotFoundError: true,               // Ignore ErrRecordNotFound error for logger
+			Colorful:                  false,              // Disable color
 		},
 	)
 
+	// 3
+	namer := opts.NamingStrategy
+	if namer == nil {
+		namer = schema.NamingStrategy{TablePrefix: opts.TablePrefix}
+	}
 	cfg := &gorm.Config{
 		Logger:                 l,
 		SkipDefaultTransaction: true,
+		NamingStrategy:         namer,
+		PrepareStmt:            opts.PrepareStmt != nil && *opts.PrepareStmt,
 	}
 
-	db, err := CreateDatabaseInstance(driver, dsn, cfg)
+	db, err := CreateDatabaseInstance(opts.Driver, opts.DSN, cfg)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return db
+	// 4
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	if opts.MaxOpenConns > 0 {
+		sqlDB.SetMaxOpenConns(opts.MaxOpenConns)
+	}
+	if opts.MaxIdleConns > 0 {
+		sqlDB.SetMaxIdleConns(opts.MaxIdleConns)
+	}
+	if opts.ConnMaxLifetime > 0 {
+		sqlDB.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	}
+	return db, nil
 }
 
 func MakeMigrates(db *gorm.DB, insts ...any) error {
 	return db.AutoMigrate(insts...)
 }
 
+// CreateDatabaseInstance open db by driver: sqlite (default), mysql, postgres or sqlserver,
+// unknown driver is an error
 func CreateDatabaseInstance(driver, dsn string, cfg *gorm.Config) (*gorm.DB, error) {
-	if driver == "mysql" {
+	switch driver {
+	case "", "sqlite", "sqlite3":
+		if dsn == "" {
+			dsn = "file::memory:"
+		}
+		return gorm.Open(sqlite.Open(dsn), cfg)
+	case "mysql":
 		return gorm.Open(mysql.Open(dsn), cfg)
+	case "postgres", "postgresql", "pgx":
+		return gorm.Open(postgres.Open(dsn), cfg)
+	case "sqlserver", "mssql":
+		return gorm.Open(sqlserver.Open(dsn), cfg)
 	}
-	if dsn == "" {
-		dsn = "file::memory:"
-	}
-	return gorm.Open(sqlite.Open(dsn), cfg)
+	return nil, fmt.Errorf("unknown database driver: %s", driver)
+}
+
+// tableOf return the table of model by the naming strategy of db, for the joins with table prefix
+func tableOf(db *gorm.DB, model any) clause.Table {
+	stmt := &gorm.Statement{DB: db}
+	stmt.Parse(model)
+	return clause.Table{Name: stmt.Table}
 }
@@ -0,0 +1,161 @@
+package rabbit
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+// TEST_POSTGRES_DSN run the tests against a local postgres, each test in a new schema
+const ENV_TEST_POSTGRES_DSN = "TEST_POSTGRES_DSN"
+
+// newTestDB return a fresh db, in-memory sqlite by default
+func newTestDB(t *testing.T) *gorm.DB {
+	dsn := os.Getenv(ENV_TEST_POSTGRES_DSN)
+	if dsn == "" {
+		return InitDatabase("", "", nil)
+	}
+
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	admin := InitDatabase("postgres", dsn, nil)
+	err := admin.Exec("CREATE SCHEMA " + schema).Error
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		if sqlDB, err := admin.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	if strings.Contains(dsn, "://") {
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += sep + "search_path=" + schema
+	} else {
+		dsn += " search_path=" + schema
+	}
+	db := InitDatabase("postgres", dsn, nil)
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+func TestCreateDatabaseInstance(t *testing.T) {
+	for _, driver := range []string{"", "sqlite", "sqlite3"} {
+		db, err := CreateDatabaseInstance(driver, "", &gorm.Config{})
+		assert.Nil(t, err, driver)
+		assert.Equal(t, "sqlite", db.Dialector.Name())
+	}
+
+	_, err := CreateDatabaseInstance("postgress", "", &gorm.Config{})
+	assert.ErrorContains(t, err, "unknown database driver: postgress")
+
+	assert.Panics(t, func() {
+		InitDatabase("oracle", "", nil)
+	})
+}
+
+func TestPostgresProfile(t *testing.T) {
+	if os.Getenv(ENV_TEST_POSTGRES_DSN) == "" {
+		t.Skip(ENV_TEST_POSTGRES_DSN + " not set")
+	}
+	db := newTestDB(t)
+	err := InitMigrate(db)
+	assert.Nil(t, err)
+
+	var dataType string
+	db.Raw("SELECT data_type FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'users' AND column_name = 'profile'").Scan(&dataType)
+	assert.Equal(t, "jsonb", dataType)
+
+	bob, _ := CreateUser(db, "bob@example.org", "123456")
+	bob.Profile = &Profile{City: "Shenzhen", Extra: map[string]any{"vip": true}}
+	err = db.Save(bob).Error
+	assert.Nil(t, err)
+
+	u, err := GetUserByEmail(db, "bob@example.org")
+	assert.Nil(t, err)
+	assert.Equal(t, "Shenzhen", u.Profile.City)
+	assert.Equal(t, true, u.Profile.Extra["vip"])
+}
+
+func TestInitDatabaseWithOptions(t *testing.T) {
+	t.Setenv("DB_MAX_OPEN_CONNS", "5")
+	t.Setenv("DB_LOG_LEVEL", "silent")
+	db, err := InitDatabaseWithOptions(DatabaseOptions{MaxIdleConns: 3, ConnMaxLifetime: time.Minute})
+	assert.Nil(t, err)
+	sqlDB, _ := db.DB()
+	assert.Equal(t, 5, sqlDB.Stats().MaxOpenConnections)
+
+	_, err = InitDatabaseWithOptions(DatabaseOptions{LogLevel: "verbose"})
+	assert.ErrorContains(t, err, "unknown database log level: verbose")
+
+	_, err = InitDatabaseWithOptions(DatabaseOptions{Driver: "oracle"})
+	assert.ErrorContains(t, err, "unknown database driver")
+
+	// explicit option wins
+	t.Setenv("DB_PREPARE_STMT", "true")
+	disabled := false
+	db, err = InitDatabaseWithOptions(DatabaseOptions{PrepareStmt: &disabled})
+	assert.Nil(t, err)
+	assert.False(t, db.Config.PrepareStmt)
+	db, err = InitDatabaseWithOptions(DatabaseOptions{})
+	assert.Nil(t, err)
+	assert.True(t, db.Config.PrepareStmt)
+
+	t.Setenv("DB_SLOW_THRESHOLD", "1")
+	_, err = InitDatabaseWithOptions(DatabaseOptions{})
+	assert.ErrorIs(t, err, ErrInvalidSetting)
+}
+
+func TestTablePrefix(t *testing.T) {
+	prepare := true
+	db, err := InitDatabaseWithOptions(DatabaseOptions{TablePrefix: "rabbit_", PrepareStmt: &prepare})
+	assert.Nil(t, err)
+	err = InitMigrate(db)
+	assert.Nil(t, err)
+	assert.True(t, db.Migrator().HasTable("rabbit_users"))
+	assert.True(t, db.Migrator().HasTable("rabbit_user_roles"))
+	assert.False(t, db.Migrator().HasTable("users"))
+
+	// joins of the built-in queries
+	bob, _ := CreateUser(db, "bob@example.org", "123456")
+	group, _ := CreateGroupByUser(db, bob.ID, "staff")
+	p, _ := SavePermission(db, 0, 0, "list user", "/user", "GET", false)
+	SavePermission(db, 0, 0, "invoice.read", "", "", false)
+	named, _ := GetPermissionByName(db, "invoice.read")
+	role, _ := AddRoleWithPermissions(db, "viewer", "VIEWER", []uint{p.ID})
+	AddRoleForUser(db, bob.ID, role.ID)
+	SetGroupPermission(db, group.ID, named.ID, false)
+
+	ok, err := CheckUserPermission(db, bob.ID, "/user", "GET")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = HasPermission(db, bob.ID, "invoice.read")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	e := NewEnforcer()
+	err = e.LoadFromDB(db)
+	assert.Nil(t, err)
+	assert.True(t, e.Enforce(UserSubject(bob.ID), "/user", "GET"))
+
+	_, err = GetPolicy(db)
+	assert.Nil(t, err)
+	_, err = GetUsageReport(db, 30)
+	assert.Nil(t, err)
+	alice, _ := CreateUser(db, "alice@example.org", "123456")
+	_, err = CopyRolesForUser(db, bob.ID, alice.ID, 0)
+	assert.Nil(t, err)
+	roles, _ := GetRolesByUser(db, alice.ID)
+	assert.Len(t, roles, 1)
+}
@@ -0,0 +1,336 @@
+package rabbit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ENV_PROFILE select the profile file, e.g. "prod" loads .env.prod after .env
+const ENV_PROFILE = "ENV_PROFILE"
+
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+/*
+EnvLoader parse the env files once, cache the values until Reload
+precedence: process env > <path>.<profile> > <path>
+*/
+type EnvLoader struct {
+	lock   sync.RWMutex
+	path   string
+	values map[string]string
+	loaded bool
+}
+
+func NewEnvLoader(path string) *EnvLoader {
+	return &EnvLoader{path: path}
+}
+
+var defaultEnv = NewEnvLoader(".env")
+
+// SetEnvFile change the path of env file used by GetEnv, default is .env
+func SetEnvFile(path string) error {
+	defaultEnv.lock.Lock()
+	defaultEnv.path = path
+	defaultEnv.lock.Unlock()
+	return defaultEnv.Reload()
+}
+
+// ReloadEnv parse the env files used by GetEnv again
+func ReloadEnv() error {
+	return defaultEnv.Reload()
+}
+
+func GetEnv(key string) string {
+	v, _ := LookupEnv(key)
+	return v
+}
+
+// LookupEnv lookup key in process env, then the env files, key is case-sensitive
+func LookupEnv(key string) (string, bool) {
+	return defaultEnv.Lookup(key)
+}
+
+func (l *EnvLoader) Lookup(key string) (string, bool) {
+	if v, ok := os.LookupEnv(key); ok {
+		return v, true
+	}
+
+	l.lock.RLock()
+	loaded := l.loaded
+	l.lock.RUnlock()
+	if !loaded {
+		if err := l.Reload(); err != nil {
+			Warningln("load env fail:", err)
+		}
+	}
+
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	v, ok := l.values[key]
+	return v, ok
+}
+
+/*
+Reload parse the env files, the malformed lines are skipped with the error returned,
+the values are kept if any file can not be read
+1. <path>, missing file is ignored
+2. profile from process env or <path>
+3. <path>.<profile> overrides <path>
+*/
+func (l *EnvLoader) Reload() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.loaded = true
+	values := map[string]string{}
+	var errs []error
+
+	// 1
+	content, err := readEnvFile(l.path)
+	if err != nil {
+		return err
+	}
+	if err := parseEnvFile(l.path, content, values); err != nil {
+		errs = append(errs, err)
+	}
+
+	// 2
+	profile, ok := os.LookupEnv(ENV_PROFILE)
+	if !ok {
+		profile = values[ENV_PROFILE]
+	}
+
+	// 3
+	if profile != "" {
+		path := l.path + "." + profile
+		content, err := readEnvFile(path)
+		if err != nil {
+			return err
+		}
+		if err := parseEnvFile(path, content, values); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	l.values = values
+	return errors.Join(errs...)
+}
+
+// content of env file, empty if not exists
+func readEnvFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(data), nil
+}
+
+// the errors of lines are prefixed by path
+func parseEnvFile(path, content string, values map[string]string) error {
+	err := ParseEnv(content, values)
+	if err == nil {
+		return nil
+	}
+	lineErrs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		lineErrs = joined.Unwrap()
+	}
+	errs := make([]error, 0, len(lineErrs))
+	for _, e := range lineErrs {
+		errs = append(errs, fmt.Errorf("%s:%w", path, e))
+	}
+	return errors.Join(errs...)
+}
+
+/*
+ParseEnv parse the content of env file into values
+
+	# comment
+	export KEY=value # inline comment
+	QUOTED="line1\nline2 ${KEY}"
+	LITERAL='${NOT_EXPANDED}'
+	DEFAULT=${MISSING:-default}
+
+${VAR} and $VAR are expanded in double quoted and unquoted values,
+by process env first, then the values parsed before.
+The malformed lines are skipped, the well-formed pairs are kept, the errors of lines are returned joined
+*/
+func ParseEnv(content string, values map[string]string) error {
+	var errs []error
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		n := i + 1
+		line := strings.TrimSpace(lines[i])
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			errs = append(errs, fmt.Errorf("%d: missing '=' in %q", n, line))
+			continue
+		}
+		key = strings.TrimSpace(key)
+		if !envKeyPattern.MatchString(key) {
+			errs = append(errs, fmt.Errorf("%d: invalid key %q", n, key))
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch {
+		case strings.HasPrefix(value, `"`):
+			// multi-line value until the closing quote
+			raw := value[1:]
+			end := findClosingQuote(raw, '"')
+			for end < 0 && i+1 < len(lines) {
+				i++
+				raw += "\n" + lines[i]
+				end = findClosingQuote(raw, '"')
+			}
+			if end < 0 {
+				// the lines after are parsed again
+				i = n - 1
+				err = fmt.Errorf("unterminated quoted value of %s", key)
+				break
+			}
+			if err = checkEnvTail(raw[end+1:]); err != nil {
+				break
+			}
+			var expanded string
+			if expanded, err = expandEnv(unescapeEnv(raw[:end]), values); err == nil {
+				values[key] = expanded
+			}
+		case strings.HasPrefix(value, `'`):
+			end := strings.IndexByte(value[1:], '\'')
+			if end < 0 {
+				err = fmt.Errorf("unterminated quoted value of %s", key)
+				break
+			}
+			if err = checkEnvTail(value[end+2:]); err != nil {
+				break
+			}
+			values[key] = value[1 : end+1]
+		default:
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			} else if i := strings.Index(value, "\t#"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+			var expanded string
+			if expanded, err = expandEnv(value, values); err == nil {
+				values[key] = expanded
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%d: %w", n, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// index of the closing quote not escaped by backslash
+func findClosingQuote(s string, quote byte) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case quote:
+			return i
+		}
+	}
+	return -1
+}
+
+// only comment is allowed after the closing quote
+func checkEnvTail(tail string) error {
+	tail = strings.TrimSpace(tail)
+	if tail != "" && tail[0] != '#' {
+		return fmt.Errorf("unexpected %q after quoted value", tail)
+	}
+	return nil
+}
+
+func unescapeEnv(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case '"', '\\':
+			b.WriteByte(s[i])
+		case '$':
+			// keep escaped for expandEnv
+			b.WriteString(`\$`)
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// expand ${VAR}, ${VAR:-default} and $VAR, \$ is a literal $
+func expandEnv(s string, values map[string]string) (string, error) {
+	lookup := func(name string) (string, bool) {
+		if v, ok := os.LookupEnv(name); ok {
+			return v, true
+		}
+		v, ok := values[name]
+		return v, ok
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == '$':
+			b.WriteByte('$')
+			i++
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated ${ in %q", s)
+			}
+			name, def, hasDefault := strings.Cut(s[i+2:i+end], ":-")
+			if v, ok := lookup(name); ok && (v != "" || !hasDefault) {
+				b.WriteString(v)
+			} else {
+				b.WriteString(def)
+			}
+			i += end
+		case s[i] == '$':
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] >= 'A' && s[j] <= 'Z' || s[j] >= 'a' && s[j] <= 'z' || j > i+1 && s[j] >= '0' && s[j] <= '9') {
+				j++
+			}
+			if j == i+1 {
+				b.WriteByte('$')
+				continue
+			}
+			v, _ := lookup(s[i+1 : j])
+			b.WriteString(v)
+			i = j - 1
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), nil
+}
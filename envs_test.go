@@ -0,0 +1,156 @@
+package rabbit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnv(t *testing.T) {
+	// not exist .env file
+	v := GetEnv("NOT_EXIST_ENV")
+	assert.Empty(t, v)
+	defer func() {
+		os.Remove(".env")
+		ReloadEnv()
+	}()
+
+	// write .env file
+	os.WriteFile(".env", []byte(`
+	#hello
+	xx
+	EXIST_ENV=100	
+	`), 0666)
+	err := ReloadEnv()
+	assert.ErrorContains(t, err, ".env:3: missing '='") // the malformed line is skipped
+
+	{
+		v = GetEnv("EXIST_ENV")
+		assert.Equal(t, v, "100")
+
+		v = GetEnv("NOT_EXIST_ENV")
+		assert.Empty(t, v)
+	}
+
+	{
+		v, ok := LookupEnv("EXIST_ENV")
+		assert.Equal(t, v, "100")
+		assert.True(t, ok)
+
+		v, ok = LookupEnv("NOT_EXIST_ENV")
+		assert.Empty(t, v)
+		assert.False(t, ok)
+	}
+
+	// fallback to process env when .env lacks the key
+	t.Setenv("PROCESS_ONLY_ENV", "1")
+	assert.Equal(t, "1", GetEnv("PROCESS_ONLY_ENV"))
+
+	// keys are case-sensitive
+	_, ok := LookupEnv("exist_env")
+	assert.False(t, ok)
+}
+
+func TestParseEnv(t *testing.T) {
+	t.Setenv("PROCESS_HOST", "db.local")
+
+	values := map[string]string{}
+	err := ParseEnv(`
+# comment
+export NAME=rabbit # inline comment
+HASH=a#b
+EMPTY=
+DOUBLE="hello \"world\"\n" # comment
+SINGLE='${NAME} # not comment'
+MULTI="line1
+line2"
+DSN=postgres://${PROCESS_HOST}/$NAME
+DEFAULT=${MISSING:-fallback}
+ESCAPED="\${NAME}"
+`, values)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"NAME":    "rabbit",
+		"HASH":    "a#b",
+		"EMPTY":   "",
+		"DOUBLE":  "hello \"world\"\n",
+		"SINGLE":  "${NAME} # not comment",
+		"MULTI":   "line1\nline2",
+		"DSN":     "postgres://db.local/rabbit",
+		"DEFAULT": "fallback",
+		"ESCAPED": "${NAME}",
+	}, values)
+
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{"xx", "1: missing '='"},
+		{"\nA B=1", "2: invalid key"},
+		{`A="open`, "1: unterminated quoted value of A"},
+		{`A='open`, "1: unterminated quoted value of A"},
+		{`A="v" tail`, "1: unexpected"},
+		{`A=${OPEN`, "1: unterminated ${"},
+	}
+	for _, tt := range tests {
+		err := ParseEnv(tt.content, map[string]string{})
+		assert.ErrorContains(t, err, tt.err, tt.content)
+	}
+
+	// the well-formed pairs are kept
+	values = map[string]string{}
+	err = ParseEnv("SESSION_SECRET=abc\nxx\nA=\"open\nDSN=file:app.db", values)
+	assert.ErrorContains(t, err, "2: missing '='")
+	assert.ErrorContains(t, err, "3: unterminated quoted value of A")
+	assert.Equal(t, map[string]string{"SESSION_SECRET": "abc", "DSN": "file:app.db"}, values)
+}
+
+func TestEnvLoaderProfile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.env")
+	os.WriteFile(path, []byte("A=base\nB=base\nENV_PROFILE=dev\nURL=http://${HOST}\nHOST=base.local\n"), 0666)
+	os.WriteFile(path+".dev", []byte("B=dev\nC=${A}-dev\n"), 0666)
+	os.WriteFile(path+".prod", []byte("B=prod\n"), 0666)
+
+	l := NewEnvLoader(path)
+	err := l.Reload()
+	assert.Nil(t, err)
+
+	v, _ := l.Lookup("A")
+	assert.Equal(t, "base", v)
+	v, _ = l.Lookup("B")
+	assert.Equal(t, "dev", v)
+	v, _ = l.Lookup("C")
+	assert.Equal(t, "base-dev", v)
+	v, _ = l.Lookup("URL")
+	assert.Equal(t, "http://", v) // expanded by the values parsed before
+
+	// process env selects profile, and takes precedence
+	t.Setenv(ENV_PROFILE, "prod")
+	l.Reload()
+	v, _ = l.Lookup("B")
+	assert.Equal(t, "prod", v)
+	t.Setenv("B", "process")
+	v, _ = l.Lookup("B")
+	assert.Equal(t, "process", v)
+
+	// malformed lines are skipped
+	t.Setenv("B", "")
+	os.Unsetenv("B")
+	os.WriteFile(path+".prod", []byte("B=prod2\nbroken\n"), 0666)
+	err = l.Reload()
+	assert.ErrorContains(t, err, "app.env.prod:2: missing '='")
+	v, _ = l.Lookup("A")
+	assert.Equal(t, "base", v)
+	v, _ = l.Lookup("B")
+	assert.Equal(t, "prod2", v)
+
+	// configurable path of GetEnv
+	defer SetEnvFile(".env")
+	t.Setenv(ENV_PROFILE, "dev")
+	err = SetEnvFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "base-dev", GetEnv("C"))
+}
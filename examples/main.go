@@ -17,13 +17,19 @@ var (
 	logFile    string
 	dbDriver   string
 	dsn        string
+	migrate    string
+	steps      int
+	dryRun     bool
 )
 
 func main() {
 	flag.StringVar(&serverAddr, "s", ":8080", "listen addr")
 	flag.StringVar(&logFile, "l", "", "log file")
-	flag.StringVar(&dbDriver, "d", "", "DB Driver, sqlite|mysql")
+	flag.StringVar(&dbDriver, "d", "", "DB Driver, sqlite|mysql|postgres|sqlserver")
 	flag.StringVar(&dsn, "n", "", "DB DSN")
+	flag.StringVar(&migrate, "migrate", "", "run migrations and exit, up|down")
+	flag.IntVar(&steps, "steps", 0, "steps of migrations, 0 means all for up, down needs >= 1")
+	flag.BoolVar(&dryRun, "dry-run", false, "print the plan of migrations only")
 	flag.Parse()
 
 	var err error
@@ -50,6 +56,31 @@ func main() {
 	// db
 	db := rabbit.InitDatabase(dbDriver, dsn, lw)
 
+	// go run main.go -migrate up -dry-run
+	if migrate != "" {
+		m, err := rabbit.NewMigrator(db, rabbit.RabbitMigrations()...)
+		if err != nil {
+			log.Fatalf("migrate fail, %v\n", err)
+		}
+		m.DryRun = dryRun
+		var plan []*rabbit.MigrationStep
+		switch migrate {
+		case rabbit.MigrationUp:
+			plan, err = m.Up(steps)
+		case rabbit.MigrationDown:
+			plan, err = m.Down(steps)
+		default:
+			log.Fatalf("unknown migrate %s, must be up|down\n", migrate)
+		}
+		for _, step := range plan {
+			rabbit.Infoln(step)
+		}
+		if err != nil {
+			log.Fatalf("migrate fail, %v\n", err)
+		}
+		return
+	}
+
 	// router
 	r := gin.New()
 	r.Use(gin.LoggerWithWriter(lw), gin.Recovery())
@@ -0,0 +1,211 @@
+package rabbit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// feature flags are stored in Config as json, key is FEATURE_<NAME>
+const featureKeyPrefix = "FEATURE_"
+
+var ErrFeatureFlagNotFound = errors.New("feature flag not found")
+
+// FeatureFlag enable the feature for everyone, or the targeted users, groups, roles and percentage of users
+type FeatureFlag struct {
+	Name    string   `json:"name"`
+	Desc    string   `json:"desc,omitempty"`
+	Enabled bool     `json:"enabled"`          // for everyone, including anonymous
+	Users   []string `json:"users,omitempty"`  // emails
+	Groups  []string `json:"groups,omitempty"` // names, matched with CurrentGroup
+	Roles   []string `json:"roles,omitempty"`  // names
+	Percent int      `json:"percent,omitempty"`
+}
+
+func featureKey(name string) string {
+	return featureKeyPrefix + strings.ToUpper(name)
+}
+
+func parseFeatureFlag(key, value string) (*FeatureFlag, error) {
+	var flag FeatureFlag
+	if err := json.Unmarshal([]byte(value), &flag); err != nil {
+		return nil, fmt.Errorf("invalid feature flag %s: %w", key, err)
+	}
+	flag.Name = strings.TrimPrefix(key, featureKeyPrefix)
+	return &flag, nil
+}
+
+// SetFeatureFlag create or update the flag, the name is case-insensitive
+func SetFeatureFlag(db *gorm.DB, flag *FeatureFlag) error {
+	if flag.Name == "" {
+		return errors.New("empty feature flag name")
+	}
+	if flag.Percent < 0 || flag.Percent > 100 {
+		return fmt.Errorf("percent of feature flag %s must be 0-100", flag.Name)
+	}
+
+	key := featureKey(flag.Name)
+	flag.Name = strings.TrimPrefix(key, featureKeyPrefix)
+	data, err := json.Marshal(flag)
+	if err != nil {
+		return err
+	}
+	return SetValue(db, key, string(data))
+}
+
+func GetFeatureFlag(db *gorm.DB, name string) (*FeatureFlag, error) {
+	key := featureKey(name)
+	value := GetValue(db, key)
+	if value == "" {
+		return nil, fmt.Errorf("%w: %s", ErrFeatureFlagNotFound, name)
+	}
+	return parseFeatureFlag(key, value)
+}
+
+// ListFeatureFlags return all flags sorted by name, the invalid ones are skipped
+func ListFeatureFlags(db *gorm.DB) ([]*FeatureFlag, error) {
+	var configs []Config
+	key := clause.Column{Name: "key"} // reserved word of sqlserver
+	result := db.Where(clause.Like{Column: key, Value: featureKeyPrefix + "%"}).
+		Order(clause.OrderByColumn{Column: key}).
+		Find(&configs)
+	if err := result.Error; err != nil {
+		return nil, err
+	}
+
+	flags := make([]*FeatureFlag, 0, len(configs))
+	for _, c := range configs {
+		if !strings.HasPrefix(c.Key, featureKeyPrefix) || c.Value == "" {
+			continue
+		}
+		flag, err := parseFeatureFlag(c.Key, c.Value)
+		if err != nil {
+			Warningln(err)
+			continue
+		}
+		flags = append(flags, flag)
+	}
+	return flags, nil
+}
+
+/*
+IsEnabledFor check the flag for user in group with the role names
+1. enabled for everyone
+2. anonymous user only sees the enabled flags
+3. targeted by email, group or role
+4. stable hash of flag name and user id in percent
+*/
+func (f *FeatureFlag) IsEnabledFor(user *User, group *Group, roles []string) bool {
+	// 1
+	if f.Enabled {
+		return true
+	}
+	// 2
+	if user == nil {
+		return false
+	}
+	// 3
+	if containsFold(f.Users, user.Email) {
+		return true
+	}
+	if group != nil && containsFold(f.Groups, group.Name) {
+		return true
+	}
+	for _, role := range roles {
+		if containsFold(f.Roles, role) {
+			return true
+		}
+	}
+	// 4
+	return f.Percent > 0 && featureBucket(f.Name, user.ID) < f.Percent
+}
+
+// bucket 0-99 of user, hashed with the flag name so the rollouts of flags are independent
+func featureBucket(name string, uid uint) int {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s:%d", strings.ToUpper(name), uid)
+	return int(h.Sum32() % 100)
+}
+
+func containsFold(items []string, s string) bool {
+	for _, item := range items {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// role names of user, only loaded if any flag targets roles
+func featureRoles(db *gorm.DB, user *User, flags ...*FeatureFlag) ([]string, error) {
+	if user == nil {
+		return nil, nil
+	}
+	needRoles := false
+	for _, f := range flags {
+		needRoles = needRoles || len(f.Roles) > 0
+	}
+	if !needRoles {
+		return nil, nil
+	}
+
+	roles, err := GetRolesByUser(db, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(roles))
+	for _, r := range roles {
+		names = append(names, r.Name)
+	}
+	return names, nil
+}
+
+// IsFeatureEnabled check the flag for user in group, missing or invalid flag is disabled
+func IsFeatureEnabled(db *gorm.DB, name string, user *User, group *Group) bool {
+	flag, err := GetFeatureFlag(db, name)
+	if err != nil {
+		if !errors.Is(err, ErrFeatureFlagNotFound) {
+			Warningln(err)
+		}
+		return false
+	}
+	roles, err := featureRoles(db, user, flag)
+	if err != nil {
+		Warningf("load roles for feature flag %s fail: %v", flag.Name, err)
+	}
+	return flag.IsEnabledFor(user, group, roles)
+}
+
+// IsEnabled check the flag for CurrentUser and CurrentGroup
+func IsEnabled(c *gin.Context, flag string) bool {
+	db := c.MustGet(DbField).(*gorm.DB)
+	return IsFeatureEnabled(db, flag, CurrentUser(c), CurrentGroup(c))
+}
+
+// GetFeaturesByUser return the names of flags enabled for user in group, sorted
+func GetFeaturesByUser(db *gorm.DB, user *User, group *Group) ([]string, error) {
+	flags, err := ListFeatureFlags(db)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := featureRoles(db, user, flags...)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, f := range flags {
+		if f.IsEnabledFor(user, group, roles) {
+			names = append(names, f.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,109 @@
+package rabbit
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeatureFlags(t *testing.T) {
+	db := initDB(t)
+
+	bob, _ := CreateUser(db, "bob@example.org", "123456")
+	alice, _ := CreateUser(db, "alice@example.org", "123456")
+	group, _ := CreateGroupByUser(db, alice.ID, "beta testers")
+	role, _ := AddRoleWithPermissions(db, "editor", "EDITOR", nil)
+	AddRoleForUser(db, alice.ID, role.ID)
+
+	assert.NotNil(t, SetFeatureFlag(db, &FeatureFlag{}))
+	assert.NotNil(t, SetFeatureFlag(db, &FeatureFlag{Name: "bad", Percent: 101}))
+
+	err := SetFeatureFlag(db, &FeatureFlag{Name: "new_ui", Enabled: true})
+	assert.Nil(t, err)
+	err = SetFeatureFlag(db, &FeatureFlag{Name: "by_user", Users: []string{"BOB@example.org"}})
+	assert.Nil(t, err)
+	err = SetFeatureFlag(db, &FeatureFlag{Name: "by_group", Groups: []string{"beta testers"}})
+	assert.Nil(t, err)
+	err = SetFeatureFlag(db, &FeatureFlag{Name: "by_role", Roles: []string{"editor"}})
+	assert.Nil(t, err)
+	err = SetFeatureFlag(db, &FeatureFlag{Name: "disabled"})
+	assert.Nil(t, err)
+	SetValue(db, "FEATURE_BROKEN", "{")
+
+	flag, err := GetFeatureFlag(db, "by_user")
+	assert.Nil(t, err)
+	assert.Equal(t, "BY_USER", flag.Name)
+	_, err = GetFeatureFlag(db, "not_exist")
+	assert.ErrorIs(t, err, ErrFeatureFlagNotFound)
+
+	flags, err := ListFeatureFlags(db)
+	assert.Nil(t, err)
+	assert.Len(t, flags, 5)
+
+	assert.True(t, IsFeatureEnabled(db, "new_ui", nil, nil))
+	assert.False(t, IsFeatureEnabled(db, "by_user", nil, nil))
+	assert.True(t, IsFeatureEnabled(db, "by_user", bob, nil))
+	assert.False(t, IsFeatureEnabled(db, "by_user", alice, nil))
+	assert.False(t, IsFeatureEnabled(db, "by_group", alice, nil))
+	assert.True(t, IsFeatureEnabled(db, "by_group", alice, group))
+	assert.True(t, IsFeatureEnabled(db, "by_role", alice, nil))
+	assert.False(t, IsFeatureEnabled(db, "by_role", bob, nil))
+	assert.False(t, IsFeatureEnabled(db, "broken", bob, nil))
+	assert.False(t, IsFeatureEnabled(db, "not_exist", bob, nil))
+
+	features, err := GetFeaturesByUser(db, alice, group)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"BY_GROUP", "BY_ROLE", "NEW_UI"}, features)
+	features, err = GetFeaturesByUser(db, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"NEW_UI"}, features)
+
+	// percentage rollout is stable and roughly proportional
+	rollout := &FeatureFlag{Name: "rollout", Percent: 30}
+	enabled := 0
+	for uid := uint(1); uid <= 1000; uid++ {
+		u := &User{ID: uid}
+		on := rollout.IsEnabledFor(u, nil, nil)
+		assert.Equal(t, on, rollout.IsEnabledFor(u, nil, nil))
+		if on {
+			enabled++
+			assert.True(t, (&FeatureFlag{Name: "rollout", Percent: 50}).IsEnabledFor(u, nil, nil))
+		}
+	}
+	assert.InDelta(t, 300, enabled, 60)
+	assert.False(t, (&FeatureFlag{Name: "rollout", Percent: 0}).IsEnabledFor(&User{ID: 1}, nil, nil))
+	assert.True(t, (&FeatureFlag{Name: "rollout", Percent: 100}).IsEnabledFor(&User{ID: 1}, nil, nil))
+}
+
+func TestFeatureHandlers(t *testing.T) {
+	db, r, client := initTestClient(t)
+	r.GET("/mock_feature", func(c *gin.Context) {
+		c.JSON(http.StatusOK, IsEnabled(c, "beta"))
+	})
+
+	SetFeatureFlag(db, &FeatureFlag{Name: "new_ui", Enabled: true})
+	SetFeatureFlag(db, &FeatureFlag{Name: "beta", Users: []string{"bob@example.org"}})
+
+	var features []string
+	err := client.CallGet("/auth/features", nil, &features)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"NEW_UI"}, features)
+
+	var enabled bool
+	err = client.CallGet("/mock_feature", nil, &enabled)
+	assert.Nil(t, err)
+	assert.False(t, enabled)
+
+	err = client.CallPost("/auth/register", RegisterUserForm{Email: "bob@example.org", Password: "123456"}, nil)
+	assert.Nil(t, err)
+
+	err = client.CallGet("/auth/features", nil, &features)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"BETA", "NEW_UI"}, features)
+
+	err = client.CallGet("/mock_feature", nil, &enabled)
+	assert.Nil(t, err)
+	assert.True(t, enabled)
+}
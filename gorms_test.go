@@ -101,7 +101,7 @@ func TestUpdateFields(t *testing.T) {
 }
 
 func TestUniqueKey(t *testing.T) {
-	db := InitDatabase("", "", nil)
+	db := newTestDB(t)
 	db.AutoMigrate(&User{}, &Config{})
 
 	v := GenUniqueKey(db.Model(User{}), "email", 10)
@@ -112,7 +112,7 @@ func TestUniqueKey(t *testing.T) {
 }
 
 func TestCount(t *testing.T) {
-	db := InitDatabase("", "", nil)
+	db := newTestDB(t)
 	db.AutoMigrate(&user{})
 
 	db.Create(&user{Name: "user1", Email: "user1@example.com", Age: 10})
@@ -29,6 +29,12 @@ type LoginForm struct {
 	AuthToken string `json:"token,omitempty"`
 }
 
+// UserInfo user with the effective capabilities
+type UserInfo struct {
+	*User
+	Capabilities UserCapabilities `json:"capabilities"`
+}
+
 type ChangePasswordForm struct {
 	Password string `json:"password" binding:"required"`
 }
@@ -39,6 +45,8 @@ func RegisterAuthenticationHandlers(prefix string, db *gorm.DB, r *gin.Engine) {
 	r.POST(filepath.Join(prefix, "register"), handleUserSignup)
 	r.GET(filepath.Join(prefix, "logout"), handleUserLogout)
 	r.POST(filepath.Join(prefix, "change_password"), handleUserChangePassword)
+	r.GET(filepath.Join(prefix, "menu"), handleUserMenu)
+	r.GET(filepath.Join(prefix, "features"), handleUserFeatures)
 }
 
 func handleUserInfo(c *gin.Context) {
@@ -47,7 +55,38 @@ func handleUserInfo(c *gin.Context) {
 		HandleErrorMessage(c, http.StatusForbidden, "user not login")
 		return
 	}
-	c.JSON(http.StatusOK, user)
+	c.JSON(http.StatusOK, UserInfo{User: user, Capabilities: user.GetCapabilities()})
+}
+
+func handleUserMenu(c *gin.Context) {
+	user := CurrentUser(c)
+	if user == nil {
+		HandleErrorMessage(c, http.StatusForbidden, "user not login")
+		return
+	}
+
+	db := c.MustGet(DbField).(*gorm.DB)
+
+	menu, err := GetMenuByUser(db, user)
+	if err != nil {
+		HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, menu)
+}
+
+// anonymous user gets the flags enabled for everyone
+func handleUserFeatures(c *gin.Context) {
+	db := c.MustGet(DbField).(*gorm.DB)
+
+	features, err := GetFeaturesByUser(db, CurrentUser(c), CurrentGroup(c))
+	if err != nil {
+		HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, features)
 }
 
 func handleUserSignin(c *gin.Context) {
@@ -97,7 +136,12 @@ func handleUserSignin(c *gin.Context) {
 	}
 
 	// if need activated
-	if GetBoolValue(db, KEY_USER_NEED_ACTIVATE) && !user.Activated {
+	needActivate, err := GetSetting[bool](db, KEY_USER_NEED_ACTIVATE)
+	if err != nil {
+		HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if needActivate && !user.Activated {
 		HandleErrorMessage(c, http.StatusUnauthorized, "waiting for activation")
 		return
 	}
@@ -161,7 +205,12 @@ func handleUserSignup(c *gin.Context) {
 		"activation": user.Activated,
 	}
 
-	if GetBoolValue(db, KEY_USER_NEED_ACTIVATE) && !user.Activated {
+	needActivate, err := GetSetting[bool](db, KEY_USER_NEED_ACTIVATE)
+	if err != nil {
+		HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if needActivate && !user.Activated {
 		// sendHashMail(db, user, SigUserVerifyEmail, KEY_VERIFY_EMAIL_EXPIRED, "180d", c.ClientIP(), c.Request.UserAgent())
 		r["expired"] = "180d"
 	} else {
@@ -197,7 +246,12 @@ func handleUserChangePassword(c *gin.Context) {
 	}
 
 	db := c.MustGet(DbField).(*gorm.DB)
-	if GetBoolValue(db, KEY_USER_NEED_ACTIVATE) && !user.Activated {
+	needActivate, err := GetSetting[bool](db, KEY_USER_NEED_ACTIVATE)
+	if err != nil {
+		HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if needActivate && !user.Activated {
 		HandleErrorMessage(c, http.StatusUnauthorized, "waiting for activation")
 		return
 	}
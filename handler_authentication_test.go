@@ -21,7 +21,7 @@ func checkResponse(t *testing.T, w *httptest.ResponseRecorder) (response map[str
 
 func initTestClient(t *testing.T) (*gorm.DB, *gin.Engine, *TestClient) {
 	gin.DisableConsoleColor()
-	db := InitDatabase("", "", nil)
+	db := newTestDB(t)
 	r := gin.Default()
 
 	InitRabbit(db, r)
@@ -32,7 +32,7 @@ func initTestClient(t *testing.T) (*gorm.DB, *gin.Engine, *TestClient) {
 
 func TestRabbitInit(t *testing.T) {
 	gin.DisableConsoleColor()
-	db := InitDatabase("", "", nil)
+	db := newTestDB(t)
 
 	r := gin.Default()
 	InitRabbit(db, r)
@@ -93,6 +93,7 @@ func TestAuthHandler(t *testing.T) {
 		vals := checkResponse(t, w)
 		assert.Contains(t, vals, "email")
 		assert.Equal(t, vals["email"], "bob@example.org")
+		assert.Equal(t, map[string]any{"superUser": false, "staff": false, "adminAccess": false}, vals["capabilities"])
 
 		// logout
 		w = client.Get("/auth/logout")
@@ -223,3 +224,47 @@ func TestAuthPassword(t *testing.T) {
 		assert.Nil(t, err)
 	}
 }
+
+func TestUserMenu(t *testing.T) {
+	db, _, client := initTestClient(t)
+
+	w := client.Get("/auth/menu")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	err := client.CallPost("/auth/register", RegisterUserForm{Email: "bob@example.org", Password: "123456"}, nil)
+	assert.Nil(t, err)
+	bob, _ := GetUserByEmail(db, "bob@example.org")
+
+	users, _ := SavePermission(db, 0, 0, "users", "/user", "", false)
+	listUser, _ := SavePermission(db, 0, users.ID, "list user", "/user", http.MethodGet, false)
+	deleteUser, _ := SavePermission(db, 0, users.ID, "delete user", "/user/:key", http.MethodDelete, false)
+	audit, _ := SavePermission(db, 0, users.ID, "audit", "/user/audit", http.MethodGet, false)
+	orders, _ := SavePermission(db, 0, 0, "orders", "/order", "", false)
+	SavePermission(db, 0, orders.ID, "list order", "/order", http.MethodGet, false)
+	ping, _ := SavePermission(db, 0, 0, "ping", "/ping", http.MethodGet, true)
+	approve, _ := SavePermission(db, 0, users.ID, "invoice.approve", "", "", false)
+	SetPermissionMenu(db, users.ID, "user", 2, false)
+	SetPermissionMenu(db, ping.ID, "", 1, false)
+	SetPermissionMenu(db, audit.ID, "", 0, true)
+
+	role, _ := AddRoleWithPermissions(db, "viewer", "VIEWER", []uint{listUser.ID, deleteUser.ID, audit.ID, approve.ID})
+	SetRolePermission(db, role.ID, deleteUser.ID, true)
+	AddRoleForUser(db, bob.ID, role.ID)
+
+	var menu []*Permission
+	err = client.CallGet("/auth/menu", nil, &menu)
+	assert.Nil(t, err)
+	assert.Len(t, menu, 2)
+	assert.Equal(t, "ping", menu[0].Name)
+	assert.Equal(t, "users", menu[1].Name)
+	assert.Equal(t, "user", menu[1].Icon)
+	assert.Len(t, menu[1].Children, 1) // the named permission without uri is not menu
+	assert.Equal(t, "list user", menu[1].Children[0].Name)
+
+	bob.IsSuperUser = true
+	menu, err = GetMenuByUser(db, bob)
+	assert.Nil(t, err)
+	assert.Len(t, menu, 3)
+	assert.Equal(t, "orders", menu[0].Name)
+	assert.Len(t, menu[2].Children, 2)
+}
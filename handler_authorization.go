@@ -1,31 +1,107 @@
 package rabbit
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/restsend/gormpher"
 	"gorm.io/gorm"
 )
 
+type UserRoleForm struct {
+	RoleID    uint      `json:"role_id" binding:"required"`
+	ExpiresAt time.Time `json:"expires_at" binding:"required"`
+}
+
+type UserIDsForm struct {
+	UserIDs []uint `json:"user_ids" binding:"required"`
+}
+
+type GroupMembersForm struct {
+	Emails []string `json:"emails" binding:"required"`
+}
+
+type CopyRolesForm struct {
+	FromUserID uint `json:"from_user_id" binding:"required"`
+}
+
 type RoleForm struct {
 	ID            uint   `json:"id"`
 	Name          string `json:"name"`
 	Label         string `json:"label"`
 	PermissionIds []uint `json:"permission_ids"`
+	// explicit deny, takes precedence over the permissions allowed by other roles,
+	// omitted keeps the current ones when update
+	DenyPermissionIds []uint `json:"deny_permission_ids"`
 }
 
 func RegisterAuthorizationHandlers(db *gorm.DB, r gin.IRoutes) {
-	r.PUT("role", handleCreateRole)
-	r.PATCH("role/:key", handleUpdateRole)
-	r.DELETE("role/:key", handleDeleteRole)
-	r.PUT("permission", handleAddPermission)
-	r.PATCH("permission/:key", handleEditPermission)
-	r.DELETE("permission/:key", handleDeletePermission)
+	NamedRoute(r, http.MethodGet, "role", "list roles", handleListRoles)
+	NamedRoute(r, http.MethodGet, "role/:key", "get role", handleGetRole)
+	NamedRoute(r, http.MethodPut, "role", "create role", handleCreateRole)
+	NamedRoute(r, http.MethodPatch, "role/:key", "update role", handleUpdateRole)
+	NamedRoute(r, http.MethodDelete, "role/:key", "delete role", handleDeleteRole)
+	NamedRoute(r, http.MethodGet, "permission/tree", "permission tree", handlePermissionTree)
+	NamedRoute(r, http.MethodPut, "permission", "create permission", handleAddPermission)
+	NamedRoute(r, http.MethodPatch, "permission/:key", "update permission", handleEditPermission)
+	NamedRoute(r, http.MethodDelete, "permission/:key", "delete permission", handleDeletePermission)
+	NamedRoute(r, http.MethodGet, "user/:uid/permissions", "user permissions", handleUserPermissions)
+	NamedRoute(r, http.MethodPut, "user/:uid/role", "grant role", RequireSuperUser(), handleGrantRole)
+	NamedRoute(r, http.MethodPut, "role/:key/users", "assign role to users", RequireSuperUser(), handleAssignRoleToUsers)
+	NamedRoute(r, http.MethodDelete, "role/:key/users", "revoke role from users", RequireSuperUser(), handleRevokeRoleFromUsers)
+	NamedRoute(r, http.MethodPut, "group/:key/members", "sync group members", RequireSuperUser(), handleSyncGroupMembers)
+	NamedRoute(r, http.MethodPost, "user/:uid/roles/copy", "copy roles", RequireSuperUser(), handleCopyRoles)
+	NamedRoute(r, http.MethodGet, "permission/explain", "explain permission", RequireSuperUser(), handleExplainPermission)
+	NamedRoute(r, http.MethodGet, "permission/usage", "permission usage", RequireSuperUser(), handlePermissionUsage)
 }
 
 // role
+func handleListRoles(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("pageSize", "20"))
+
+	db := c.MustGet(DbField).(*gorm.DB)
+
+	items, total, err := ListRoles(db, page, pageSize)
+	if err != nil {
+		HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"items":    items,
+		"total":    total,
+		"page":     page,
+		"pageSize": pageSize,
+	})
+}
+
+func handleGetRole(c *gin.Context) {
+	roleID, err := strconv.Atoi(c.Param("key"))
+	if err != nil {
+		HandleErrorMessage(c, http.StatusBadRequest, "role id invalid")
+		return
+	}
+
+	db := c.MustGet(DbField).(*gorm.DB)
+
+	role, err := GetRoleWithPermissions(db, uint(roleID))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			HandleErrorMessage(c, http.StatusNotFound, "role not found")
+			return
+		}
+		HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, role)
+}
+
 func handleCreateRole(c *gin.Context) {
 	var form RoleForm
 	if err := c.BindJSON(&form); err != nil {
@@ -41,8 +117,13 @@ func handleCreateRole(c *gin.Context) {
 		return
 	}
 
-	role, err := AddRoleWithPermissions(db, form.Name, form.Label, form.PermissionIds)
-
+	var role *Role
+	err = db.Transaction(func(tx *gorm.DB) (err error) {
+		if role, err = AddRoleWithPermissions(tx, form.Name, form.Label, form.PermissionIds); err != nil {
+			return err
+		}
+		return SetRoleDenyPermissions(tx, role.ID, form.DenyPermissionIds)
+	})
 	if err != nil {
 		HandleError(c, http.StatusInternalServerError, err)
 		return
@@ -66,7 +147,16 @@ func handleUpdateRole(c *gin.Context) {
 
 	db := c.MustGet(DbField).(*gorm.DB)
 
-	role, err := UpdateRoleWithPermissions(db, uint(roleID), form.Name, form.Label, form.PermissionIds)
+	var role *Role
+	err = db.Transaction(func(tx *gorm.DB) (err error) {
+		if role, err = UpdateRoleWithPermissions(tx, uint(roleID), form.Name, form.Label, form.PermissionIds); err != nil {
+			return err
+		}
+		if form.DenyPermissionIds == nil {
+			return nil
+		}
+		return UpdateRoleDenyPermissions(tx, role.ID, form.DenyPermissionIds)
+	})
 	if err != nil {
 		HandleError(c, http.StatusInternalServerError, err)
 		return
@@ -108,7 +198,14 @@ func handleAddPermission(c *gin.Context) {
 
 	db := c.MustGet(DbField).(*gorm.DB)
 
-	p, err := SavePermission(db, 0, form.ParentID, form.Name, form.Uri, form.Method, form.Anonymous)
+	var p *Permission
+	err := db.Transaction(func(tx *gorm.DB) (err error) {
+		if p, err = SavePermission(tx, 0, form.ParentID, form.Name, form.Uri, form.Method, form.Anonymous); err != nil {
+			return err
+		}
+		p.Icon, p.Order, p.Hidden = form.Icon, form.Order, form.Hidden
+		return SetPermissionMenu(tx, p.ID, form.Icon, form.Order, form.Hidden)
+	})
 	if err != nil {
 		HandleError(c, http.StatusInternalServerError, err)
 		return
@@ -117,6 +214,18 @@ func handleAddPermission(c *gin.Context) {
 	c.JSON(http.StatusOK, p)
 }
 
+func handlePermissionTree(c *gin.Context) {
+	db := c.MustGet(DbField).(*gorm.DB)
+
+	tree, err := GetPermissionTree(db)
+	if err != nil {
+		HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, tree)
+}
+
 func handleDeletePermission(c *gin.Context) {
 	pID, err := strconv.Atoi(c.Param("key"))
 	if err != nil {
@@ -142,5 +251,216 @@ func handleDeletePermission(c *gin.Context) {
 
 func handleEditPermission(c *gin.Context) {
 	db := c.MustGet(DbField).(*gorm.DB)
-	gormpher.HandleEdit[Permission](c, db, []string{"Name", "Anonymous", "P1", "P2", "P3"}, nil)
+	gormpher.HandleEdit[Permission](c, db, []string{"Name", "Anonymous", "Icon", "Order", "Hidden", "P1", "P2", "P3"}, nil)
+}
+
+// user
+func handleUserPermissions(c *gin.Context) {
+	uid, err := strconv.Atoi(c.Param("uid"))
+	if err != nil {
+		HandleErrorMessage(c, http.StatusBadRequest, "user id invalid")
+		return
+	}
+
+	db := c.MustGet(DbField).(*gorm.DB)
+
+	ps, err := GetPermissionsByUser(db, uint(uid))
+	if err != nil {
+		HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, ps)
+}
+
+// grant a role to the user until expires_at
+func handleGrantRole(c *gin.Context) {
+	uid, err := strconv.Atoi(c.Param("uid"))
+	if err != nil {
+		HandleErrorMessage(c, http.StatusBadRequest, "user id invalid")
+		return
+	}
+
+	var form UserRoleForm
+	if err := c.BindJSON(&form); err != nil {
+		HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if !form.ExpiresAt.After(time.Now()) {
+		HandleErrorMessage(c, http.StatusBadRequest, "expires_at must be in the future")
+		return
+	}
+
+	db := c.MustGet(DbField).(*gorm.DB)
+
+	if _, err := GetByID[User](db, uint(uid)); err != nil {
+		HandleErrorMessage(c, http.StatusBadRequest, "user not found")
+		return
+	}
+
+	if _, err := GetRoleByID(db, form.RoleID); err != nil {
+		HandleErrorMessage(c, http.StatusBadRequest, "role not found")
+		return
+	}
+
+	var grantedBy uint
+	if user := CurrentUser(c); user != nil {
+		grantedBy = user.ID
+	}
+
+	if err := AddRoleForUserUntil(db, uint(uid), form.RoleID, form.ExpiresAt, grantedBy); err != nil {
+		HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, true)
+}
+
+// only superuser can explain the permission of other users
+func handleExplainPermission(c *gin.Context) {
+	uid, err := strconv.Atoi(c.Query("uid"))
+	if err != nil {
+		HandleErrorMessage(c, http.StatusBadRequest, "user id invalid")
+		return
+	}
+
+	uri, method := c.Query("uri"), c.Query("method")
+	if uri == "" || method == "" {
+		HandleErrorMessage(c, http.StatusBadRequest, "uri and method are required")
+		return
+	}
+
+	db := c.MustGet(DbField).(*gorm.DB)
+
+	explain, err := ExplainUserPermission(db, uint(uid), uri, strings.ToUpper(method))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			HandleErrorMessage(c, http.StatusNotFound, "user not found")
+			return
+		}
+		HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, explain)
+}
+
+func handlePermissionUsage(c *gin.Context) {
+	days, err := strconv.Atoi(c.DefaultQuery("days", "90"))
+	if err != nil || days <= 0 {
+		HandleErrorMessage(c, http.StatusBadRequest, "days invalid")
+		return
+	}
+
+	db := c.MustGet(DbField).(*gorm.DB)
+
+	report, err := GetUsageReport(db, days)
+	if err != nil {
+		HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// bulk
+func handleAssignRoleToUsers(c *gin.Context) {
+	grantedBy := CurrentUser(c).ID
+	handleBulkRoleUsers(c, func(db *gorm.DB, rid uint, uids []uint) ([]*BulkResult, error) {
+		return AssignRoleToUsers(db, rid, uids, grantedBy)
+	})
+}
+
+func handleRevokeRoleFromUsers(c *gin.Context) {
+	handleBulkRoleUsers(c, RevokeRoleFromUsers)
+}
+
+func handleBulkRoleUsers(c *gin.Context, fn func(db *gorm.DB, rid uint, uids []uint) ([]*BulkResult, error)) {
+	roleID, err := strconv.Atoi(c.Param("key"))
+	if err != nil {
+		HandleErrorMessage(c, http.StatusBadRequest, "role id invalid")
+		return
+	}
+
+	var form UserIDsForm
+	if err := c.BindJSON(&form); err != nil {
+		HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	db := c.MustGet(DbField).(*gorm.DB)
+
+	results, err := fn(db, uint(roleID), form.UserIDs)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			HandleErrorMessage(c, http.StatusNotFound, "role not found")
+			return
+		}
+		HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, results)
+}
+
+func handleSyncGroupMembers(c *gin.Context) {
+	groupID, err := strconv.Atoi(c.Param("key"))
+	if err != nil {
+		HandleErrorMessage(c, http.StatusBadRequest, "group id invalid")
+		return
+	}
+
+	var form GroupMembersForm
+	if err := c.BindJSON(&form); err != nil {
+		HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	db := c.MustGet(DbField).(*gorm.DB)
+
+	results, err := SyncGroupMembers(db, uint(groupID), form.Emails)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			HandleErrorMessage(c, http.StatusNotFound, "group not found")
+			return
+		}
+		HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, results)
+}
+
+func handleCopyRoles(c *gin.Context) {
+	uid, err := strconv.Atoi(c.Param("uid"))
+	if err != nil {
+		HandleErrorMessage(c, http.StatusBadRequest, "user id invalid")
+		return
+	}
+
+	var form CopyRolesForm
+	if err := c.BindJSON(&form); err != nil {
+		HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	db := c.MustGet(DbField).(*gorm.DB)
+
+	var grantedBy uint
+	if user := CurrentUser(c); user != nil {
+		grantedBy = user.ID
+	}
+
+	results, err := CopyRolesForUser(db, form.FromUserID, uint(uid), grantedBy)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			HandleErrorMessage(c, http.StatusNotFound, "user not found")
+			return
+		}
+		HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, results)
 }
@@ -1 +1,203 @@
 package rabbit
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func initAuthorizationClient(t *testing.T) (*gorm.DB, *gin.Engine, *TestClient) {
+	db, r, client := initTestClient(t)
+	RegisterAuthorizationHandlers(db, r.Group("/api"))
+	return db, r, client
+}
+
+// register and login as a superuser
+func loginSuperUser(t *testing.T, db *gorm.DB, client *TestClient) *User {
+	err := client.CallPost("/auth/register", RegisterUserForm{Email: "root@example.org", Password: "123456"}, nil)
+	assert.Nil(t, err)
+	u, _ := GetUserByEmail(db, "root@example.org")
+	UpdateFields(db, u, map[string]any{"IsSuperUser": true})
+	return u
+}
+
+func TestAuthorizationReadHandlers(t *testing.T) {
+	db, _, client := initAuthorizationClient(t)
+
+	p1, _ := SavePermission(db, 0, 0, "user", "/user", "", false)
+	p11, _ := SavePermission(db, 0, p1.ID, "list user", "/user", http.MethodGet, false)
+	p12, _ := SavePermission(db, 0, p1.ID, "delete user", "/user/:key", http.MethodDelete, false)
+	SavePermission(db, 0, p11.ID, "export user", "/user/export", http.MethodGet, false)
+
+	admin, _ := AddRoleWithPermissions(db, "admin", "ADMIN", []uint{p11.ID, p12.ID})
+	AddRoleWithPermissions(db, "guest", "GUEST", nil)
+	support, _ := AddRoleWithPermissions(db, "support", "SUPPORT", []uint{p11.ID})
+
+	// list roles
+	{
+		var r struct {
+			Items []RoleItem `json:"items"`
+			Total int        `json:"total"`
+		}
+		err := client.CallGet("/api/role?page=1&pageSize=2", nil, &r)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, r.Total)
+		assert.Len(t, r.Items, 2)
+		assert.Equal(t, "admin", r.Items[0].Name)
+		assert.Equal(t, 2, r.Items[0].PermissionCount)
+		assert.Equal(t, 0, r.Items[1].PermissionCount)
+
+		err = client.CallGet("/api/role?page=2&pageSize=2", nil, &r)
+		assert.Nil(t, err)
+		assert.Len(t, r.Items, 1)
+		assert.Equal(t, 1, r.Items[0].PermissionCount)
+	}
+
+	// get role
+	{
+		var role Role
+		err := client.CallGet(fmt.Sprintf("/api/role/%d", admin.ID), nil, &role)
+		assert.Nil(t, err)
+		assert.Equal(t, "admin", role.Name)
+		assert.Len(t, role.Permissions, 2)
+
+		SetRoleDenyPermissions(db, support.ID, []uint{p12.ID})
+		err = client.CallGet(fmt.Sprintf("/api/role/%d", support.ID), nil, &role)
+		assert.Nil(t, err)
+		assert.Len(t, role.Permissions, 2)
+		for _, p := range role.Permissions {
+			assert.Equal(t, p.ID == p12.ID, p.Deny)
+		}
+
+		// the denied ones are kept if omitted
+		err = client.CallPatch(fmt.Sprintf("/api/role/%d", support.ID), RoleForm{Name: "support", Label: "SUPPORT"}, nil)
+		assert.Nil(t, err)
+		ps, _ := GetPermissionsByRole(db, support.ID)
+		assert.Len(t, ps, 1)
+		assert.True(t, ps[0].Deny)
+
+		err = client.CallPatch(fmt.Sprintf("/api/role/%d", support.ID), RoleForm{Name: "support", Label: "SUPPORT", PermissionIds: []uint{p11.ID}, DenyPermissionIds: []uint{}}, nil)
+		assert.Nil(t, err)
+		ps, _ = GetPermissionsByRole(db, support.ID)
+		assert.Len(t, ps, 1)
+		assert.False(t, ps[0].Deny)
+
+		w := client.Get("/api/role/999")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	}
+
+	// permission tree
+	{
+		var tree []*Permission
+		err := client.CallGet("/api/permission/tree", nil, &tree)
+		assert.Nil(t, err)
+		assert.Len(t, tree, 1)
+		assert.Len(t, tree[0].Children, 2)
+		assert.Len(t, tree[0].Children[0].Children, 1)
+		assert.Equal(t, "export user", tree[0].Children[0].Children[0].Name)
+	}
+
+	// user permissions
+	{
+		u, _ := CreateUser(db, "bob@example.org", "123456")
+		UpdateRolesForUser(db, u.ID, []uint{admin.ID, support.ID})
+
+		var ps []*Permission
+		err := client.CallGet(fmt.Sprintf("/api/user/%d/permissions", u.ID), nil, &ps)
+		assert.Nil(t, err)
+		assert.Len(t, ps, 2)
+	}
+}
+
+func TestExplainPermissionHandler(t *testing.T) {
+	db, _, client := initAuthorizationClient(t)
+
+	err := client.CallPost("/auth/register", RegisterUserForm{Email: "bob@example.org", Password: "123456"}, nil)
+	assert.Nil(t, err)
+	u, _ := GetUserByEmail(db, "bob@example.org")
+	SavePermission(db, 0, 0, "list user", "/user", http.MethodGet, true)
+
+	url := fmt.Sprintf("/api/permission/explain?uid=%d&uri=/user&method=get", u.ID)
+
+	w := client.Get(url)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	UpdateFields(db, u, map[string]any{"IsSuperUser": true})
+
+	var explain PermissionExplain
+	err = client.CallGet(url, nil, &explain)
+	assert.Nil(t, err)
+	assert.True(t, explain.Allowed)
+	assert.Equal(t, http.MethodGet, explain.Method)
+
+	w = client.Get("/api/permission/explain?uid=999&uri=/user&method=GET")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestGrantRoleHandler(t *testing.T) {
+	db, _, client := initAuthorizationClient(t)
+
+	u, _ := CreateUser(db, "bob@example.org", "123456")
+	role, _ := CreateRole(db, "oncall", "ONCALL")
+	url := fmt.Sprintf("/api/user/%d/role", u.ID)
+
+	err := client.CallPut(url, UserRoleForm{RoleID: role.ID, ExpiresAt: time.Now().Add(time.Hour)}, nil)
+	assert.Contains(t, err.Error(), "user need login")
+
+	loginSuperUser(t, db, client)
+	err = client.CallPut(url, UserRoleForm{RoleID: role.ID, ExpiresAt: time.Now().Add(-time.Hour)}, nil)
+	assert.Contains(t, err.Error(), "expires_at must be in the future")
+
+	err = client.CallPut(url, UserRoleForm{RoleID: 999, ExpiresAt: time.Now().Add(time.Hour)}, nil)
+	assert.Contains(t, err.Error(), "role not found")
+
+	err = client.CallPut(url, UserRoleForm{RoleID: role.ID, ExpiresAt: time.Now().Add(time.Hour)}, nil)
+	assert.Nil(t, err)
+
+	roles, _ := GetRolesByUser(db, u.ID)
+	assert.Len(t, roles, 1)
+}
+
+func TestBulkRoleHandlers(t *testing.T) {
+	db, _, client := initAuthorizationClient(t)
+
+	bob, _ := CreateUser(db, "bob@example.org", "123456")
+	alice, _ := CreateUser(db, "alice@example.org", "123456")
+	role, _ := CreateRole(db, "viewer", "VIEWER")
+	group, _ := CreateGroupByUser(db, bob.ID, "dev")
+	url := fmt.Sprintf("/api/role/%d/users", role.ID)
+
+	client.CallPost("/auth/register", RegisterUserForm{Email: "carol@example.org", Password: "123456"}, nil)
+	err := client.CallPut(url, UserIDsForm{UserIDs: []uint{bob.ID}}, nil)
+	assert.Contains(t, err.Error(), "superuser required")
+
+	loginSuperUser(t, db, client)
+	var results []*BulkResult
+	err = client.CallPut(url, UserIDsForm{UserIDs: []uint{bob.ID}}, &results)
+	assert.Nil(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, BulkCreated, results[0].Status)
+
+	err = client.CallPut("/api/role/999/users", UserIDsForm{UserIDs: []uint{bob.ID}}, nil)
+	assert.Contains(t, err.Error(), "role not found")
+
+	err = client.CallPost(fmt.Sprintf("/api/user/%d/roles/copy", alice.ID), CopyRolesForm{FromUserID: bob.ID}, &results)
+	assert.Nil(t, err)
+	assert.Equal(t, "viewer", results[0].Key)
+
+	err = client.CallDelete(url, UserIDsForm{UserIDs: []uint{bob.ID, alice.ID}}, &results)
+	assert.Nil(t, err)
+	assert.Len(t, results, 2)
+
+	err = client.CallPut(fmt.Sprintf("/api/group/%d/members", group.ID), GroupMembersForm{Emails: []string{"alice@example.org"}}, &results)
+	assert.Nil(t, err)
+	assert.Len(t, results, 2)
+
+	users, _ := GetUsersByRole(db, role.ID)
+	assert.Len(t, users, 0)
+}
@@ -0,0 +1,125 @@
+package rabbit
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type RollbackConfigForm struct {
+	HistoryID uint `json:"history_id"` // 0 means the latest change
+}
+
+// RegisterConfigHandlers register the config handlers, superuser only
+func RegisterConfigHandlers(db *gorm.DB, r gin.IRoutes) {
+	NamedRoute(r, http.MethodGet, "config", "list configs", RequireSuperUser(), handleListConfigs)
+	NamedRoute(r, http.MethodPatch, "config", "update configs", RequireSuperUser(), handleUpdateConfigs)
+	NamedRoute(r, http.MethodGet, "config/:key/history", "config history", RequireSuperUser(), handleConfigHistory)
+	NamedRoute(r, http.MethodPost, "config/:key/rollback", "rollback config", RequireSuperUser(), handleRollbackConfig)
+}
+
+func handleListConfigs(c *gin.Context) {
+	db := c.MustGet(DbField).(*gorm.DB)
+
+	items, err := ListConfigs(db)
+	if err != nil {
+		HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, items)
+}
+
+// PATCH {"API_NEED_AUTH": "true", ...}
+func handleUpdateConfigs(c *gin.Context) {
+	var form map[string]string
+	if err := c.BindJSON(&form); err != nil {
+		HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	db := c.MustGet(DbField).(*gorm.DB)
+
+	items, err := ListConfigs(db)
+	if err != nil {
+		HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	exists := map[string]bool{}
+	for _, item := range items {
+		exists[item.Key] = true
+	}
+	for key := range form {
+		if !exists[strings.ToUpper(key)] {
+			HandleErrorMessage(c, http.StatusBadRequest, "config "+key+" not found")
+			return
+		}
+		// only the rollback can restore the encrypted value
+		if isSecretValue(form[key]) {
+			HandleErrorMessage(c, http.StatusBadRequest, "config "+key+" can not be encrypted value")
+			return
+		}
+	}
+
+	changes, err := UpdateValues(db, form, CurrentUser(c).ID)
+	if err != nil {
+		if errors.Is(err, ErrInvalidSetting) {
+			HandleError(c, http.StatusBadRequest, err)
+			return
+		}
+		HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, changes)
+}
+
+func handleConfigHistory(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 {
+		HandleErrorMessage(c, http.StatusBadRequest, "limit invalid")
+		return
+	}
+
+	db := c.MustGet(DbField).(*gorm.DB)
+
+	items, err := GetConfigHistory(db, c.Param("key"), limit)
+	if err != nil {
+		HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, items)
+}
+
+func handleRollbackConfig(c *gin.Context) {
+	var form RollbackConfigForm
+	if c.Request.ContentLength > 0 {
+		if err := c.BindJSON(&form); err != nil {
+			HandleError(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	db := c.MustGet(DbField).(*gorm.DB)
+
+	change, err := RollbackValue(db, c.Param("key"), form.HistoryID, CurrentUser(c).ID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			HandleErrorMessage(c, http.StatusNotFound, "config history not found")
+			return
+		}
+		if errors.Is(err, ErrInvalidSetting) {
+			HandleError(c, http.StatusBadRequest, err)
+			return
+		}
+		HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, change)
+}
@@ -0,0 +1,80 @@
+package rabbit
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigHandlers(t *testing.T) {
+	db, r, client := initTestClient(t)
+	RegisterConfigHandlers(db, r.Group("/api"))
+
+	w := client.Get("/api/config")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	err := client.CallPost("/auth/register", RegisterUserForm{Email: "bob@example.org", Password: "123456"}, nil)
+	assert.Nil(t, err)
+	bob, _ := GetUserByEmail(db, "bob@example.org")
+
+	w = client.Get("/api/config")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	UpdateFields(db, bob, map[string]any{"IsSuperUser": true})
+
+	var items []*ConfigItem
+	err = client.CallGet("/api/config", nil, &items)
+	assert.Nil(t, err)
+	var needAuth *ConfigItem
+	for _, item := range items {
+		if item.Key == KEY_API_NEED_AUTH {
+			needAuth = item
+		}
+	}
+	assert.NotNil(t, needAuth)
+	assert.Equal(t, SettingBool, needAuth.Type)
+	assert.Equal(t, "false", needAuth.Value)
+	assert.NotEmpty(t, needAuth.Desc)
+
+	// validated by type
+	err = client.CallPatch("/api/config", map[string]string{KEY_API_NEED_AUTH: "maybe"}, nil)
+	assert.Contains(t, err.Error(), "invalid value of setting API_NEED_AUTH")
+	err = client.CallPatch("/api/config", map[string]string{"NOT_EXIST": "1"}, nil)
+	assert.Contains(t, err.Error(), "config NOT_EXIST not found")
+	err = client.CallPatch("/api/config", map[string]string{KEY_API_AUTH_SHADOW: "enc:k1:AAAA"}, nil)
+	assert.Contains(t, err.Error(), "can not be encrypted value")
+
+	var changes []*ConfigHistory
+	err = client.CallPatch("/api/config", map[string]string{KEY_USER_NEED_ACTIVATE: "true", KEY_API_AUTH_SHADOW: "false"}, &changes)
+	assert.Nil(t, err)
+	assert.Len(t, changes, 1) // unchanged is not recorded
+	assert.Equal(t, "false", changes[0].OldValue)
+	assert.Equal(t, "true", changes[0].NewValue)
+	assert.Equal(t, bob.ID, changes[0].ActorID)
+	assert.True(t, GetBoolValue(db, KEY_USER_NEED_ACTIVATE))
+
+	client.CallPatch("/api/config", map[string]string{"user_need_activate": "false"}, nil)
+	client.CallPatch("/api/config", map[string]string{"user_need_activate": "true"}, nil)
+
+	var history []*ConfigHistory
+	err = client.CallGet("/api/config/USER_NEED_ACTIVATE/history", nil, &history)
+	assert.Nil(t, err)
+	assert.Len(t, history, 3)
+
+	// rollback the latest change
+	var change ConfigHistory
+	err = client.CallPost("/api/config/USER_NEED_ACTIVATE/rollback", nil, &change)
+	assert.Nil(t, err)
+	assert.Equal(t, "false", change.NewValue)
+	assert.False(t, GetBoolValue(db, KEY_USER_NEED_ACTIVATE))
+
+	// restore the value before a specific change
+	err = client.CallPost("/api/config/USER_NEED_ACTIVATE/rollback", RollbackConfigForm{HistoryID: history[1].ID}, &change)
+	assert.Nil(t, err)
+	assert.Equal(t, "true", change.NewValue)
+
+	err = client.CallPost(fmt.Sprintf("/api/config/%s/rollback", KEY_API_AUTH_SHADOW), nil, nil)
+	assert.Contains(t, err.Error(), "config history not found")
+}
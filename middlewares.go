@@ -100,33 +100,186 @@ func WithAuthentication() gin.HandlerFunc {
 	}
 }
 
+// RequireSuperUser only superuser can pass
+func RequireSuperUser() gin.HandlerFunc {
+	return requireUser("superuser required", func(user *User) bool {
+		return user.IsSuperUser
+	})
+}
+
+// RequireStaff staff or superuser can pass,
+// use with WithAuthorization to check the permissions of staff
+func RequireStaff() gin.HandlerFunc {
+	return requireUser("staff required", func(user *User) bool {
+		return user.IsSuperUser || user.IsStaff
+	})
+}
+
+// RequirePermission check the named permission of current user, superuser no need to check
+func RequirePermission(name string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		user := CurrentUser(ctx)
+		if user == nil {
+			HandleErrorMessage(ctx, http.StatusUnauthorized, "user need login")
+			return
+		}
+
+		if !user.IsSuperUser {
+			db := ctx.MustGet(DbField).(*gorm.DB)
+			pass, err := HasPermission(db, user.ID, name)
+			if err != nil {
+				HandleError(ctx, http.StatusInternalServerError, err)
+				return
+			}
+			if !pass {
+				HandleErrorMessage(ctx, http.StatusForbidden, "permission denied")
+				return
+			}
+		}
+
+		ctx.Next()
+	}
+}
+
+func requireUser(msg string, check func(user *User) bool) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		user := CurrentUser(ctx)
+		if user == nil {
+			HandleErrorMessage(ctx, http.StatusUnauthorized, "user need login")
+			return
+		}
+		if !check(user) {
+			HandleErrorMessage(ctx, http.StatusForbidden, msg)
+			return
+		}
+		ctx.Next()
+	}
+}
+
+type WithAuthorizationOptions struct {
+	// Prefix is stripped from the route path, the rest is the uri of permission,
+	// routes not under Prefix are not checked
+	Prefix string
+	// Authorizer check the permission, nil means DefaultAuthorizer
+	Authorizer Authorizer
+	// SkipPaths are the full route paths not checked, e.g. "/api/ping"
+	SkipPaths []string
+	// Status of the denied requests, default is 403
+	Status int
+	// OnDenied write the response of the denied requests, default is HandleErrorMessage,
+	// status is 401 for anonymous user, Status for denied user
+	OnDenied func(c *gin.Context, status int, msg string)
+}
+
 // check if the user has permission to access the url
 // superuser no need to check
+// policies of the permission are checked after the role based check passes
+// in shadow mode (KEY_API_AUTH_SHADOW), denials are logged without blocking
 func WithAuthorization(prefix string) gin.HandlerFunc {
+	return WithAuthorizationConfig(WithAuthorizationOptions{Prefix: prefix})
+}
+
+// WithAuthorizationBy like WithAuthorization, check by the authorizer, nil means DefaultAuthorizer
+func WithAuthorizationBy(prefix string, authorizer Authorizer) gin.HandlerFunc {
+	return WithAuthorizationConfig(WithAuthorizationOptions{Prefix: prefix, Authorizer: authorizer})
+}
+
+/*
+WithAuthorizationConfig like WithAuthorization with options
+1. pass the unmatched routes, routes not under Prefix and SkipPaths
+2. pass if KEY_API_NEED_AUTH is false, 500 if the setting is invalid
+3. 401 if user not login
+4. Status if denied by authorizer or policies, 500 if check fail
+*/
+func WithAuthorizationConfig(opts WithAuthorizationOptions) gin.HandlerFunc {
+	if opts.Authorizer == nil {
+		opts.Authorizer = DefaultAuthorizer
+	}
+	if opts.Status == 0 {
+		opts.Status = http.StatusForbidden
+	}
+	if opts.OnDenied == nil {
+		opts.OnDenied = HandleErrorMessage
+	}
+	skipPaths := make(map[string]bool, len(opts.SkipPaths))
+	for _, p := range opts.SkipPaths {
+		skipPaths[p] = true
+	}
+
 	return func(ctx *gin.Context) {
 		db := ctx.MustGet(DbField).(*gorm.DB)
 
-		if !GetBoolValue(db, KEY_API_NEED_AUTH) {
+		// 1
+		fullPath := ctx.FullPath()
+		url, ok := routeURI(fullPath, opts.Prefix)
+		if fullPath == "" || !ok || skipPaths[fullPath] {
 			ctx.Next()
+			return
 		}
-
-		url := ctx.FullPath()[len(prefix):]
 		method := ctx.Request.Method
 
+		// 2, the routes to fix the setting are outside Prefix or in SkipPaths
+		needAuth, err := GetSetting[bool](db, KEY_API_NEED_AUTH)
+		if err != nil {
+			HandleError(ctx, http.StatusInternalServerError, err)
+			return
+		}
+		if !needAuth {
+			ctx.Next()
+			return
+		}
+
+		// 3
 		user := CurrentUser(ctx)
 		if user == nil {
-			HandleErrorMessage(ctx, http.StatusUnauthorized, "user need login")
+			opts.OnDenied(ctx, http.StatusUnauthorized, "user need login")
+			ctx.Abort()
 			return
 		}
 
+		// 4
 		if !user.IsSuperUser {
-			pass, err := CheckUserPermission(db, user.ID, url, method)
+			reason := ""
+			pass, err := opts.Authorizer.Authorize(db, user, url, method)
+			if err == nil && pass {
+				pass, err = checkRoutePolicies(ctx, db, user, url, method)
+				reason = "denied by policy"
+			}
 			if err != nil || !pass {
-				HandleErrorMessage(ctx, http.StatusUnauthorized, "permission denied")
+				if shadow, serr := GetSetting[bool](db, KEY_API_AUTH_SHADOW); serr != nil {
+					Warningln(serr) // enforced if the shadow mode is unknown
+				} else if shadow {
+					logShadowDenial(db, user, url, method, reason, err)
+					ctx.Next()
+					return
+				}
+				if err != nil {
+					HandleError(ctx, http.StatusInternalServerError, err)
+					return
+				}
+				opts.OnDenied(ctx, opts.Status, "permission denied")
+				ctx.Abort()
 				return
 			}
+			if DefaultUsageRecorder != nil {
+				DefaultUsageRecorder.Record(user.ID, url, method)
+			}
 		}
 
 		ctx.Next()
 	}
 }
+
+func logShadowDenial(db *gorm.DB, user *User, url, method, reason string, err error) {
+	if err != nil {
+		Warningf("shadow mode: permission denied, uid: %d %s %s, error: %v", user.ID, method, url, err)
+		return
+	}
+	if reason == "" {
+		reason = "not granted"
+		if explain, err := ExplainUserPermission(db, user.ID, url, method); err == nil {
+			reason = explain.Reason
+		}
+	}
+	Warningf("shadow mode: permission denied, uid: %d %s %s, reason: %s", user.ID, method, url, reason)
+}
@@ -1,9 +1,11 @@
 package rabbit
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 
 	"github.com/gin-contrib/sessions"
@@ -154,3 +156,206 @@ func TestWithGormDB(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.Code)
 	assert.Equal(t, fmt.Sprintf("%v", db), resp.Body.String())
 }
+
+func TestWithAuthorizationShadow(t *testing.T) {
+	db, r, client := initTestClient(t)
+	SetValue(db, KEY_API_NEED_AUTH, "true")
+
+	ar := r.Group("/api").Use(WithAuthentication(), WithAuthorizationConfig(WithAuthorizationOptions{Prefix: "/api", SkipPaths: []string{"/api/ping"}}))
+	ar.GET("/secret", func(ctx *gin.Context) { ctx.JSON(http.StatusOK, true) })
+	ar.GET("/ping", func(ctx *gin.Context) { ctx.JSON(http.StatusOK, true) })
+	r.GET("/outside", WithAuthorization("/api"), func(ctx *gin.Context) { ctx.JSON(http.StatusOK, true) })
+
+	err := client.CallPost("/auth/register", RegisterUserForm{Email: "bob@example.org", Password: "123456"}, nil)
+	assert.Nil(t, err)
+
+	w := client.Get("/api/secret")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	SetValue(db, KEY_API_AUTH_SHADOW, "true")
+	w = client.Get("/api/secret")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// enforced if the shadow mode is invalid
+	db.Model(&Config{}).Where("key", KEY_API_AUTH_SHADOW).UpdateColumn("value", "maybe")
+	w = client.Get("/api/secret")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// not skipped if the auth setting is invalid
+	db.Model(&Config{}).Where("key", KEY_API_NEED_AUTH).UpdateColumn("value", "maybe")
+	w = client.Get("/api/secret")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	// the unprotected routes still pass
+	w = client.Get("/api/ping")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = client.Get("/outside")
+	assert.Equal(t, http.StatusOK, w.Code)
+	err = client.CallPost("/auth/login", LoginForm{Email: "bob@example.org", Password: "123456"}, nil)
+	assert.Nil(t, err)
+}
+
+func TestRequireStaff(t *testing.T) {
+	db, r, client := initTestClient(t)
+	SetValue(db, KEY_API_NEED_AUTH, "true")
+
+	admin := r.Group("/admin").Use(WithAuthentication(), RequireStaff(), WithAuthorization("/admin"))
+	admin.GET("/users", func(ctx *gin.Context) { ctx.JSON(http.StatusOK, true) })
+	admin.GET("/stats", func(ctx *gin.Context) { ctx.JSON(http.StatusOK, true) })
+	r.GET("/root", WithAuthentication(), RequireSuperUser(), func(ctx *gin.Context) { ctx.JSON(http.StatusOK, true) })
+
+	w := client.Get("/root")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	err := client.CallPost("/auth/register", RegisterUserForm{Email: "bob@example.org", Password: "123456"}, nil)
+	assert.Nil(t, err)
+	bob, _ := GetUserByEmail(db, "bob@example.org")
+
+	w = client.Get("/admin/users")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// staff still need permission
+	UpdateFields(db, bob, map[string]any{"IsStaff": true})
+	p, _ := SavePermission(db, 0, 0, "list users", "/users", http.MethodGet, false)
+	role, _ := AddRoleWithPermissions(db, "staff", "STAFF", []uint{p.ID})
+	AddRoleForUser(db, bob.ID, role.ID)
+
+	w = client.Get("/admin/users")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = client.Get("/admin/stats")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = client.Get("/root")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// superuser pass all
+	UpdateFields(db, bob, map[string]any{"IsStaff": false, "IsSuperUser": true})
+	w = client.Get("/admin/stats")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = client.Get("/root")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRequirePermission(t *testing.T) {
+	db, r, client := initTestClient(t)
+
+	r.POST("/invoice/approve", WithAuthentication(), RequirePermission("invoice.approve"), func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, true)
+	})
+
+	err := client.CallPost("/auth/register", RegisterUserForm{Email: "bob@example.org", Password: "123456"}, nil)
+	assert.Nil(t, err)
+	bob, _ := GetUserByEmail(db, "bob@example.org")
+
+	err = client.CallPost("/invoice/approve", nil, nil)
+	assert.Contains(t, err.Error(), "permission denied")
+
+	p, _ := SavePermission(db, 0, 0, "invoice.*", "", "", false)
+	role, _ := AddRoleWithPermissions(db, "accountant", "ACCOUNTANT", []uint{p.ID})
+	AddRoleForUser(db, bob.ID, role.ID)
+
+	err = client.CallPost("/invoice/approve", nil, nil)
+	assert.Nil(t, err)
+
+	// db error is not a denial
+	db.Migrator().DropTable(&RolePermission{})
+	w := client.Post("/invoice/approve", nil)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+type authorizerFunc func(db *gorm.DB, user *User, uri, method string) (bool, error)
+
+func (f authorizerFunc) Authorize(db *gorm.DB, user *User, uri, method string) (bool, error) {
+	return f(db, user, uri, method)
+}
+
+func TestWithAuthorizationConfig(t *testing.T) {
+	db := initDB(t)
+	bob, _ := CreateUser(db, "bob@example.org", "123456")
+	root, _ := CreateUser(db, "root@example.org", "123456")
+	root.IsSuperUser = true
+
+	listUser, _ := SavePermission(db, 0, 0, "list user", "/user", http.MethodGet, false)
+	SavePermission(db, 0, 0, "ping", "/", http.MethodGet, true)
+	role, _ := AddRoleWithPermissions(db, "viewer", "VIEWER", []uint{listUser.ID})
+	AddRoleForUser(db, bob.ID, role.ID)
+
+	failing := authorizerFunc(func(db *gorm.DB, user *User, uri, method string) (bool, error) {
+		return false, errors.New("authorizer down")
+	})
+	teapot := func(c *gin.Context, status int, msg string) {
+		c.String(http.StatusTeapot, "%d %s", status, msg)
+	}
+
+	tests := []struct {
+		name     string
+		needAuth bool
+		shadow   bool
+		policy   PolicyFunc
+		user     *User
+		opts     WithAuthorizationOptions
+		method   string
+		path     string
+		code     int
+		body     string
+	}{
+		{name: "auth disabled", needAuth: false, path: "/api/order", code: http.StatusOK, body: "ok"},
+		{name: "unmatched route", needAuth: true, user: bob, path: "/missing", code: http.StatusNotFound},
+		{name: "unmatched method", needAuth: true, user: bob, method: http.MethodDelete, path: "/api/user", code: http.StatusNotFound},
+		{name: "outside prefix", needAuth: true, path: "/outside", code: http.StatusOK, body: "ok"},
+		{name: "outside prefix boundary", needAuth: true, path: "/apiv2/order", code: http.StatusOK, body: "ok"},
+		{name: "skip path", needAuth: true, opts: WithAuthorizationOptions{SkipPaths: []string{"/api/order"}}, path: "/api/order", code: http.StatusOK, body: "ok"},
+		{name: "not login", needAuth: true, path: "/api/user", code: http.StatusUnauthorized},
+		{name: "allowed", needAuth: true, user: bob, path: "/api/user", code: http.StatusOK, body: "ok"},
+		{name: "prefix only", needAuth: true, user: bob, path: "/api", code: http.StatusOK, body: "ok"},
+		{name: "denied", needAuth: true, user: bob, path: "/api/order", code: http.StatusForbidden},
+		{name: "denied with status", needAuth: true, user: bob, opts: WithAuthorizationOptions{Status: http.StatusUnauthorized}, path: "/api/order", code: http.StatusUnauthorized},
+		{name: "denied by policy", needAuth: true, user: bob, policy: func(c *gin.Context, user *User) (bool, error) { return false, nil }, path: "/api/user", code: http.StatusForbidden},
+		{name: "on denied", needAuth: true, user: bob, opts: WithAuthorizationOptions{OnDenied: teapot}, path: "/api/order", code: http.StatusTeapot, body: "403 permission denied"},
+		{name: "on denied not login", needAuth: true, opts: WithAuthorizationOptions{OnDenied: teapot}, path: "/api/order", code: http.StatusTeapot, body: "401 user need login"},
+		{name: "authorizer error", needAuth: true, user: bob, opts: WithAuthorizationOptions{Authorizer: failing}, path: "/api/user", code: http.StatusInternalServerError},
+		{name: "shadow", needAuth: true, shadow: true, user: bob, path: "/api/order", code: http.StatusOK, body: "ok"},
+		{name: "superuser", needAuth: true, user: root, opts: WithAuthorizationOptions{Authorizer: failing}, path: "/api/order", code: http.StatusOK, body: "ok"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetValue(db, KEY_API_NEED_AUTH, strconv.FormatBool(tt.needAuth))
+			SetValue(db, KEY_API_AUTH_SHADOW, strconv.FormatBool(tt.shadow))
+			if tt.policy != nil {
+				RegisterPolicy(listUser.Name, tt.policy)
+				defer RemovePolicies(listUser.Name)
+			}
+
+			opts := tt.opts
+			if opts.Prefix == "" {
+				opts.Prefix = "/api"
+			}
+
+			r := gin.New()
+			r.Use(WithGormDB(db), WithMemSession("secret"), func(ctx *gin.Context) {
+				if tt.user != nil {
+					ctx.Set(UserField, tt.user)
+				}
+			}, WithAuthorizationConfig(opts))
+			handler := func(ctx *gin.Context) { ctx.String(http.StatusOK, "ok") }
+			r.GET("/api", handler)
+			r.GET("/api/user", handler)
+			r.GET("/api/order", handler)
+			r.GET("/outside", handler)
+			r.GET("/apiv2/order", handler)
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, tt.path, nil)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.code, w.Code)
+			if tt.body != "" {
+				assert.Equal(t, tt.body, w.Body.String())
+			}
+		})
+	}
+}
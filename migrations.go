@@ -0,0 +1,330 @@
+package rabbit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	MigrationUp   = "up"
+	MigrationDown = "down"
+)
+
+var ErrMigrationLocked = errors.New("migration is locked by another runner")
+var ErrMigrationLockLost = errors.New("migration lock is lost")
+
+/*
+Migration is a named schema change, in Go or SQL, the Go funcs take precedence.
+AutoMigrate still handles the additive changes, migrations are for renames, backfills and drops.
+DDL is not transactional on mysql, a failed migration may be applied partially
+*/
+type Migration struct {
+	ID      string // applied in the order of ID, e.g. 20230601_add_user_phone
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+	UpSQL   string
+	DownSQL string
+}
+
+// SchemaMigration record the applied migrations
+type SchemaMigration struct {
+	ID        string    `json:"id" gorm:"primaryKey;size:128"`
+	AppliedAt time.Time `json:"appliedAt"`
+}
+
+// SchemaMigrationLock prevent the concurrent runners of replicas, only one row
+type SchemaMigrationLock struct {
+	ID        uint      `json:"id" gorm:"primaryKey;autoIncrement:false"`
+	Owner     string    `json:"owner" gorm:"size:128"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// MigrationStep is a planned or applied step of Migrator
+type MigrationStep struct {
+	ID        string `json:"id"`
+	Direction string `json:"direction"`
+	SQL       string `json:"sql,omitempty"` // empty for Go migrations
+}
+
+func (s *MigrationStep) String() string {
+	if s.SQL != "" {
+		return fmt.Sprintf("%s %s: %s", s.Direction, s.ID, s.SQL)
+	}
+	return fmt.Sprintf("%s %s", s.Direction, s.ID)
+}
+
+type Migrator struct {
+	// LockTimeout is the time to wait for the lock of other runners, default 30s
+	LockTimeout time.Duration
+	// LockTTL expire the lock of the crashed runner, default 10m, renewed every LockTTL/3 while running
+	LockTTL time.Duration
+	// DryRun only return the plan, nothing is changed, the tables of Migrator are not created
+	DryRun bool
+
+	db         *gorm.DB
+	migrations []*Migration
+	owner      string
+}
+
+func NewMigrator(db *gorm.DB, migrations ...*Migration) (*Migrator, error) {
+	seen := map[string]bool{}
+	for _, m := range migrations {
+		if m.ID == "" {
+			return nil, errors.New("empty migration id")
+		}
+		if seen[m.ID] {
+			return nil, fmt.Errorf("duplicate migration %s", m.ID)
+		}
+		if m.Up == nil && m.UpSQL == "" {
+			return nil, fmt.Errorf("migration %s has no up", m.ID)
+		}
+		seen[m.ID] = true
+	}
+
+	sorted := append([]*Migration{}, migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	host, _ := os.Hostname()
+	return &Migrator{
+		LockTimeout: 30 * time.Second,
+		LockTTL:     10 * time.Minute,
+		db:          db,
+		migrations:  sorted,
+		owner:       host + ":" + strconv.Itoa(os.Getpid()) + ":" + strconv.FormatInt(time.Now().UnixNano(), 36),
+	}, nil
+}
+
+// Applied return the applied migrations, sorted by id
+func (m *Migrator) Applied() ([]*SchemaMigration, error) {
+	if m.DryRun {
+		if !m.db.Migrator().HasTable(&SchemaMigration{}) {
+			return nil, nil
+		}
+	} else if err := m.db.AutoMigrate(&SchemaMigration{}, &SchemaMigrationLock{}); err != nil {
+		return nil, err
+	}
+	var applied []*SchemaMigration
+	if err := m.db.Order("id").Find(&applied).Error; err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// Plan return the pending steps of Up (steps <= 0 means all), or the last steps of Down (steps >= 1)
+func (m *Migrator) Plan(direction string, steps int) ([]*MigrationStep, error) {
+	applied, err := m.Applied()
+	if err != nil {
+		return nil, err
+	}
+	_, plan, err := m.plan(applied, direction, steps)
+	return plan, err
+}
+
+func (m *Migrator) plan(applied []*SchemaMigration, direction string, steps int) ([]*Migration, []*MigrationStep, error) {
+	done := map[string]bool{}
+	for _, a := range applied {
+		done[a.ID] = true
+	}
+
+	var todo []*Migration
+	switch direction {
+	case MigrationUp:
+		for _, mg := range m.migrations {
+			if !done[mg.ID] {
+				todo = append(todo, mg)
+			}
+		}
+	case MigrationDown:
+		if steps < 1 {
+			return nil, nil, errors.New("steps of migrate down must be >= 1")
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			if done[m.migrations[i].ID] {
+				todo = append(todo, m.migrations[i])
+			}
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown migration direction: %s", direction)
+	}
+	if steps > 0 && len(todo) > steps {
+		todo = todo[:steps]
+	}
+
+	plan := make([]*MigrationStep, 0, len(todo))
+	for _, mg := range todo {
+		step := &MigrationStep{ID: mg.ID, Direction: direction}
+		if direction == MigrationUp && mg.Up == nil {
+			step.SQL = mg.UpSQL
+		}
+		if direction == MigrationDown {
+			if mg.Down == nil && mg.DownSQL == "" {
+				return nil, nil, fmt.Errorf("migration %s is irreversible", mg.ID)
+			}
+			if mg.Down == nil {
+				step.SQL = mg.DownSQL
+			}
+		}
+		plan = append(plan, step)
+	}
+	return todo, plan, nil
+}
+
+// Up apply the pending migrations in order, steps <= 0 means all
+func (m *Migrator) Up(steps int) ([]*MigrationStep, error) {
+	return m.run(MigrationUp, steps)
+}
+
+// Down revert the last applied migrations, steps must be >= 1, never all at once
+func (m *Migrator) Down(steps int) ([]*MigrationStep, error) {
+	return m.run(MigrationDown, steps)
+}
+
+/*
+run the plan under the lock
+1. plan with the applied migrations read after locked
+2. the lock is renewed and checked before each migration
+3. each migration and its record in a transaction
+4. return the steps done before the error
+*/
+func (m *Migrator) run(direction string, steps int) ([]*MigrationStep, error) {
+	if m.DryRun {
+		return m.Plan(direction, steps)
+	}
+
+	if _, err := m.Applied(); err != nil {
+		return nil, err
+	}
+	unlock, err := m.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// 1
+	applied, err := m.Applied()
+	if err != nil {
+		return nil, err
+	}
+	todo, plan, err := m.plan(applied, direction, steps)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, mg := range todo {
+		// 2
+		if err := m.renewLock(); err != nil {
+			return plan[:i], fmt.Errorf("migrate %s %s fail: %w", direction, mg.ID, err)
+		}
+		// 3
+		err := m.db.Transaction(func(tx *gorm.DB) error {
+			if direction == MigrationUp {
+				if err := runMigration(tx, mg.Up, mg.UpSQL); err != nil {
+					return err
+				}
+				return tx.Create(&SchemaMigration{ID: mg.ID, AppliedAt: time.Now()}).Error
+			}
+			if err := runMigration(tx, mg.Down, mg.DownSQL); err != nil {
+				return err
+			}
+			return tx.Where("id", mg.ID).Delete(&SchemaMigration{}).Error
+		})
+		if err != nil {
+			// 4
+			return plan[:i], fmt.Errorf("migrate %s %s fail: %w", direction, mg.ID, err)
+		}
+		Infoln("migrate", direction, mg.ID)
+	}
+	return plan, nil
+}
+
+func runMigration(tx *gorm.DB, fn func(tx *gorm.DB) error, sql string) error {
+	if fn != nil {
+		return fn(tx)
+	}
+	return tx.Exec(sql).Error
+}
+
+// lock wait for the lock until LockTimeout, the expired lock of crashed runner is taken over
+func (m *Migrator) lock() (unlock func(), err error) {
+	deadline := time.Now().Add(m.LockTimeout)
+	for {
+		now := time.Now()
+		if err := m.db.Where("expires_at < ?", now).Delete(&SchemaMigrationLock{}).Error; err != nil {
+			return nil, err
+		}
+		result := m.db.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&SchemaMigrationLock{ID: 1, Owner: m.owner, ExpiresAt: now.Add(m.LockTTL)})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 1 {
+			break
+		}
+		if now.After(deadline) {
+			return nil, ErrMigrationLocked
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// heartbeat, the long migration is not taken over by other runners
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	interval := m.LockTTL / 3
+	if interval < time.Second {
+		interval = time.Second
+	}
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := m.renewLock(); err != nil {
+					Warningln("renew migration lock fail:", err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		if err := m.db.Where("owner", m.owner).Delete(&SchemaMigrationLock{}).Error; err != nil {
+			Warningln("release migration lock fail:", err)
+		}
+	}, nil
+}
+
+// renewLock extend the lock held by m, ErrMigrationLockLost if taken over by other runner
+func (m *Migrator) renewLock() error {
+	result := m.db.Model(&SchemaMigrationLock{}).
+		Where("id", 1).
+		Where("owner", m.owner).
+		Update("expires_at", time.Now().Add(m.LockTTL))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrMigrationLockLost
+	}
+	return nil
+}
+
+// RunMigrations apply the pending migrations
+func RunMigrations(db *gorm.DB, migrations ...*Migration) ([]*MigrationStep, error) {
+	m, err := NewMigrator(db, migrations...)
+	if err != nil {
+		return nil, err
+	}
+	return m.Up(0)
+}
@@ -0,0 +1,186 @@
+package rabbit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestMigrator(t *testing.T) {
+	db := newTestDB(t)
+
+	type note struct {
+		ID    uint `gorm:"primarykey"`
+		Title string
+	}
+	migrations := []*Migration{
+		{
+			ID:      "0002_add_body",
+			UpSQL:   "ALTER TABLE notes ADD COLUMN body TEXT",
+			DownSQL: "ALTER TABLE notes DROP COLUMN body",
+		},
+		{
+			ID: "0001_create_notes",
+			Up: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&note{})
+			},
+			Down: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&note{})
+			},
+		},
+		{
+			ID:    "0003_backfill",
+			UpSQL: "UPDATE notes SET body = title",
+		},
+	}
+
+	_, err := NewMigrator(db, &Migration{ID: "a", UpSQL: "SELECT 1"}, &Migration{ID: "a", UpSQL: "SELECT 1"})
+	assert.ErrorContains(t, err, "duplicate migration a")
+	_, err = NewMigrator(db, &Migration{ID: "a"})
+	assert.ErrorContains(t, err, "has no up")
+
+	m, err := NewMigrator(db, migrations...)
+	assert.Nil(t, err)
+
+	// dry run
+	m.DryRun = true
+	plan, err := m.Up(0)
+	assert.Nil(t, err)
+	assert.Len(t, plan, 3)
+	assert.Equal(t, "up 0001_create_notes", plan[0].String())
+	assert.Equal(t, "ALTER TABLE notes ADD COLUMN body TEXT", plan[1].SQL)
+	assert.False(t, db.Migrator().HasTable(&note{}))
+	assert.False(t, db.Migrator().HasTable(&SchemaMigration{}))
+	m.DryRun = false
+
+	steps, err := m.Up(2)
+	assert.Nil(t, err)
+	assert.Len(t, steps, 2)
+	assert.True(t, db.Migrator().HasColumn(&note{}, "body"))
+	db.Create(&note{Title: "hello"})
+
+	steps, err = m.Up(0)
+	assert.Nil(t, err)
+	assert.Len(t, steps, 1)
+	var body string
+	db.Table("notes").Select("body").Scan(&body)
+	assert.Equal(t, "hello", body)
+
+	applied, err := m.Applied()
+	assert.Nil(t, err)
+	assert.Len(t, applied, 3)
+
+	// nothing pending
+	steps, err = m.Up(0)
+	assert.Nil(t, err)
+	assert.Len(t, steps, 0)
+
+	// irreversible
+	_, err = m.Down(1)
+	assert.ErrorContains(t, err, "0003_backfill is irreversible")
+	_, err = m.Plan("sideways", 0)
+	assert.NotNil(t, err)
+	_, err = m.Down(0)
+	assert.ErrorContains(t, err, "must be >= 1")
+
+	migrations[2].DownSQL = "UPDATE notes SET body = NULL"
+	m, _ = NewMigrator(db, migrations...)
+	plan, err = m.Plan(MigrationDown, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"0003_backfill", "0002_add_body", "0001_create_notes"}, []string{plan[0].ID, plan[1].ID, plan[2].ID})
+
+	steps, err = m.Down(2)
+	assert.Nil(t, err)
+	assert.Len(t, steps, 2)
+	assert.False(t, db.Migrator().HasColumn(&note{}, "body"))
+	applied, _ = m.Applied()
+	assert.Len(t, applied, 1)
+
+	// failed migration is rolled back, the steps done are returned
+	m, _ = NewMigrator(db, append(migrations, &Migration{
+		ID: "0004_fail",
+		Up: func(tx *gorm.DB) error {
+			tx.Create(&note{Title: "rolled back"})
+			return errors.New("mock error")
+		},
+	})...)
+	steps, err = m.Up(0)
+	assert.ErrorContains(t, err, "migrate up 0004_fail fail: mock error")
+	assert.Len(t, steps, 2)
+	var count int64
+	db.Model(&note{}).Where("title", "rolled back").Count(&count)
+	assert.Equal(t, int64(0), count)
+	applied, _ = m.Applied()
+	assert.Len(t, applied, 3)
+}
+
+func TestMigratorLock(t *testing.T) {
+	db := newTestDB(t)
+	m, err := NewMigrator(db, &Migration{ID: "0001", UpSQL: "CREATE TABLE lock_test (id INTEGER)"})
+	assert.Nil(t, err)
+	m.LockTimeout = 200 * time.Millisecond
+	m.Applied()
+
+	// held by another runner
+	db.Create(&SchemaMigrationLock{ID: 1, Owner: "other", ExpiresAt: time.Now().Add(time.Minute)})
+	_, err = m.Up(0)
+	assert.ErrorIs(t, err, ErrMigrationLocked)
+	assert.False(t, db.Migrator().HasTable("lock_test"))
+
+	// the expired lock is taken over, and released after run
+	db.Model(&SchemaMigrationLock{}).Where("id", 1).Update("expires_at", time.Now().Add(-time.Second))
+	_, err = m.Up(0)
+	assert.Nil(t, err)
+	assert.True(t, db.Migrator().HasTable("lock_test"))
+	var count int64
+	db.Model(&SchemaMigrationLock{}).Count(&count)
+	assert.Equal(t, int64(0), count)
+
+	// the lock taken over while running stops the next migration
+	m, _ = NewMigrator(db,
+		&Migration{ID: "0002", Up: func(tx *gorm.DB) error {
+			return tx.Model(&SchemaMigrationLock{}).Where("id", 1).Update("owner", "other").Error
+		}},
+		&Migration{ID: "0003", UpSQL: "CREATE TABLE lock_test_3 (id INTEGER)"},
+	)
+	steps, err := m.Up(0)
+	assert.ErrorIs(t, err, ErrMigrationLockLost)
+	assert.Len(t, steps, 1)
+	assert.False(t, db.Migrator().HasTable("lock_test_3"))
+}
+
+func TestRabbitMigrations(t *testing.T) {
+	db := initDB(t)
+
+	var applied []SchemaMigration
+	db.Order("id").Find(&applied)
+	assert.Len(t, applied, len(RabbitMigrations()))
+	assert.Equal(t, "rabbit_0001_init", applied[0].ID)
+
+	// again is noop
+	err := InitMigrate(db)
+	assert.Nil(t, err)
+
+	// backfill
+	m, _ := NewMigrator(db, RabbitMigrations()...)
+	_, err = m.Down(1)
+	assert.Nil(t, err)
+	db.Create(&Config{Key: "OLD_KEY", Value: "1"})
+	db.Model(&Config{}).Where("key", "OLD_KEY").UpdateColumn("updated_at", nil)
+	_, err = m.Up(0)
+	assert.Nil(t, err)
+	var c Config
+	db.Where("key", "OLD_KEY").Take(&c)
+	assert.False(t, c.UpdatedAt.IsZero())
+
+	// the init migration never drops the tables
+	_, err = m.Down(0)
+	assert.ErrorContains(t, err, "must be >= 1")
+	_, err = m.Down(2)
+	assert.ErrorContains(t, err, "rabbit_0001_init is irreversible")
+	assert.True(t, db.Migrator().HasTable(&User{}))
+	assert.True(t, db.Migrator().HasTable(&Config{}))
+}
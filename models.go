@@ -3,9 +3,11 @@ package rabbit
 import (
 	"database/sql/driver"
 	"encoding/json"
+	"fmt"
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
 )
 
 type Config struct {
@@ -13,6 +15,19 @@ type Config struct {
 	Key   string `json:"key" gorm:"size:128,uniqueIndex"`
 	Value string `json:"value"`
 	Desc  string `json:"desc" gorm:"size: 200"`
+
+	Secret    bool      `json:"secret" gorm:"default:false"` // value is encrypted by SetSecretValue
+	UpdatedAt time.Time `json:"updatedAt" gorm:"index"`      // polled by ConfigStore
+}
+
+// ConfigHistory record the changes of Config by UpdateValues and RollbackValue
+type ConfigHistory struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"createdAt"`
+	Key       string    `json:"key" gorm:"size:128;index"`
+	OldValue  string    `json:"oldValue"`
+	NewValue  string    `json:"newValue"`
+	ActorID   uint      `json:"actorId"`
 }
 
 type Profile struct {
@@ -25,16 +40,29 @@ type Profile struct {
 }
 
 func (p *Profile) Scan(value any) error {
-	if value == nil {
+	switch v := value.(type) {
+	case nil:
 		return nil
+	case string:
+		return json.Unmarshal([]byte(v), p)
+	case []byte:
+		return json.Unmarshal(v, p)
 	}
-	return json.Unmarshal(value.([]byte), p)
+	return fmt.Errorf("can not scan %T into Profile", value)
 }
 
 func (p Profile) Value() (driver.Value, error) {
 	return json.Marshal(p)
 }
 
+// jsonb on postgres, the default type of other drivers
+func (Profile) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	if db.Dialector.Name() == "postgres" {
+		return "jsonb"
+	}
+	return ""
+}
+
 type User struct {
 	ID        uint      `json:"id" gorm:"primarykey"`
 	CreatedAt time.Time `json:"createdAt"`
@@ -46,6 +74,7 @@ type User struct {
 	LastName    string     `json:"lastName,omitempty" gorm:"size:128"`
 	DisplayName string     `json:"displayName,omitempty" gorm:"size:128"`
 	IsSuperUser bool       `json:"isSuper"`
+	IsStaff     bool       `json:"isStaff"` // can access admin area, but still checked by permissions
 	Enabled     bool       `json:"enabled"`
 	Activated   bool       `json:"activated"`
 	LastLogin   *time.Time `json:"lastLogin,omitempty"`
@@ -58,7 +87,6 @@ type User struct {
 	AuthToken string   `json:"token,omitempty" gorm:"-"`
 
 	// TODO:
-	// IsStaff     bool       `json:"-"`
 	// Phone       string     `json:"phone,omitempty" gorm:"size:64;index"`
 
 	// for association
@@ -103,17 +131,26 @@ type Permission struct {
 	Method    string `json:"method" gorm:"size:200"`
 	Anonymous bool   `json:"anonymous"` // any role can access
 
+	// for menu
+	Icon   string `json:"icon,omitempty" gorm:"size:200"`
+	Order  int    `json:"order,omitempty" gorm:"column:sort_order"`
+	Hidden bool   `json:"hidden,omitempty" gorm:"default:false"`
+
 	// for association
 	Groups []*Group `json:"groups" gorm:"many2many:group_permissions;"`
 	Roles  []*Role  `json:"roles" gorm:"many2many:role_permissions;"`
 
 	// for tree
 	Children []*Permission `json:"children,omitempty" gorm:"-"`
+	// for role, denied by the role, see GetRoleWithPermissions
+	Deny bool `json:"deny,omitempty" gorm:"-"`
 }
 
 type UserRole struct {
-	UserID uint `json:"-" gorm:"primarykey"`
-	RoleID uint `json:"-" gorm:"primarykey"`
+	UserID    uint       `json:"-" gorm:"primarykey"`
+	RoleID    uint       `json:"-" gorm:"primarykey"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" gorm:"index"` // nil means never expires
+	GrantedBy uint       `json:"grantedBy,omitempty"`
 
 	// for association
 	User User `json:"user"`
@@ -133,12 +170,39 @@ type GroupMember struct {
 type RolePermission struct {
 	RoleID       uint `json:"-" gorm:"primarykey"`
 	PermissionID uint `json:"-" gorm:"primarykey"`
+	Deny         bool `json:"deny" gorm:"default:false"` // explicit deny, takes precedence over any allow
 
 	// for association
 	Role       Role       `json:"role"`
 	Permission Permission `json:"permission"`
 }
 
+type GroupPermission struct {
+	GroupID      uint `json:"-" gorm:"primarykey"`
+	PermissionID uint `json:"-" gorm:"primarykey"`
+	Deny         bool `json:"deny" gorm:"default:false"` // explicit deny, takes precedence over any allow
+
+	// for association
+	Group      Group      `json:"group"`
+	Permission Permission `json:"permission"`
+}
+
+// hits of permission granted by role, recorded by WithAuthorization
+type PermissionUsage struct {
+	PermissionID uint      `json:"permissionId" gorm:"primarykey"`
+	RoleID       uint      `json:"roleId" gorm:"primarykey"`
+	Hits         int64     `json:"hits"`
+	LastUsedAt   time.Time `json:"lastUsedAt" gorm:"index"`
+}
+
+// hits of role exercised by user, recorded by WithAuthorization
+type RoleUsage struct {
+	UserID     uint      `json:"userId" gorm:"primarykey"`
+	RoleID     uint      `json:"roleId" gorm:"primarykey"`
+	Hits       int64     `json:"hits"`
+	LastUsedAt time.Time `json:"lastUsedAt" gorm:"index"`
+}
+
 func (u *User) GetVisibleName() string {
 	if u.DisplayName != "" {
 		return u.DisplayName
@@ -149,6 +213,21 @@ func (u *User) GetVisibleName() string {
 	return u.LastName
 }
 
+// capabilities for frontend to decide which screens to show
+type UserCapabilities struct {
+	SuperUser   bool `json:"superUser"`
+	Staff       bool `json:"staff"`
+	AdminAccess bool `json:"adminAccess"` // staff or superuser
+}
+
+func (u *User) GetCapabilities() UserCapabilities {
+	return UserCapabilities{
+		SuperUser:   u.IsSuperUser,
+		Staff:       u.IsStaff,
+		AdminAccess: u.IsSuperUser || u.IsStaff,
+	}
+}
+
 func (u *User) GetProfile() Profile {
 	if u.Profile != nil {
 		return *u.Profile
@@ -156,11 +235,48 @@ func (u *User) GetProfile() Profile {
 	return Profile{}
 }
 
+// the models of rabbit, in the order of AutoMigrate
+func rabbitModels() []any {
+	return []any{
+		&Config{},
+		&ConfigHistory{},
+		&User{},
+		&Group{},
+		&Role{},
+		&Permission{},
+		&UserRole{},
+		&RolePermission{},
+		&GroupMember{},
+		&GroupPermission{},
+		&PermissionUsage{},
+		&RoleUsage{},
+	}
+}
+
+/*
+InitMigrate migrate the models of rabbit
+1. AutoMigrate for the additive changes
+2. RabbitMigrations for the changes AutoMigrate can't do
+*/
 func InitMigrate(db *gorm.DB) error {
+	// both sides of many2many need the join table,
+	// otherwise the extra columns of join model may not be migrated
 	if err := db.SetupJoinTable(&User{}, "Roles", &UserRole{}); err != nil {
 		return err
 	}
 
+	if err := db.SetupJoinTable(&Role{}, "Users", &UserRole{}); err != nil {
+		return err
+	}
+
+	if err := db.SetupJoinTable(&Role{}, "Permissions", &RolePermission{}); err != nil {
+		return err
+	}
+
+	if err := db.SetupJoinTable(&Group{}, "Users", &GroupMember{}); err != nil {
+		return err
+	}
+
 	if err := db.SetupJoinTable(&User{}, "Groups", &GroupMember{}); err != nil {
 		return err
 	}
@@ -169,13 +285,39 @@ func InitMigrate(db *gorm.DB) error {
 		return err
 	}
 
-	return db.AutoMigrate(
-		&Config{},
-		&User{},
-		&Group{},
-		&Role{},
-		&UserRole{},
-		&RolePermission{},
-		&GroupMember{},
-	)
+	if err := db.SetupJoinTable(&Permission{}, "Groups", &GroupPermission{}); err != nil {
+		return err
+	}
+
+	// 1
+	if err := db.AutoMigrate(rabbitModels()...); err != nil {
+		return err
+	}
+
+	// 2
+	_, err := RunMigrations(db, RabbitMigrations()...)
+	return err
+}
+
+// RabbitMigrations is the schema evolution of rabbit models, applied by InitMigrate
+func RabbitMigrations() []*Migration {
+	return []*Migration{
+		{
+			ID: "rabbit_0001_init",
+			Up: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(rabbitModels()...)
+			},
+			// irreversible, reverting would drop all the tables of rabbit
+		},
+		{
+			// configs created before UpdatedAt are not seen by ConfigStore.Poll
+			ID: "rabbit_0002_backfill_config_updated_at",
+			Up: func(tx *gorm.DB) error {
+				return tx.Model(&Config{}).Where("updated_at IS NULL").UpdateColumn("updated_at", time.Now()).Error
+			},
+			Down: func(tx *gorm.DB) error {
+				return nil
+			},
+		},
+	}
 }
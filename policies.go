@@ -0,0 +1,132 @@
+package rabbit
+
+import (
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// PolicyFunc check the access after the role based check passes, e.g. owner of the record
+type PolicyFunc func(c *gin.Context, user *User) (allow bool, err error)
+
+var policies = map[string][]PolicyFunc{}
+var policiesLock sync.RWMutex
+
+// RegisterPolicy add policy for the permission name, all policies of the permission must allow
+func RegisterPolicy(permission string, policy PolicyFunc) {
+	policiesLock.Lock()
+	defer policiesLock.Unlock()
+	policies[permission] = append(policies[permission], policy)
+}
+
+func RemovePolicies(permission string) {
+	policiesLock.Lock()
+	defer policiesLock.Unlock()
+	delete(policies, permission)
+}
+
+func hasPolicies() bool {
+	policiesLock.RLock()
+	defer policiesLock.RUnlock()
+	return len(policies) > 0
+}
+
+func CheckPolicies(c *gin.Context, user *User, permission string) (bool, error) {
+	policiesLock.RLock()
+	ps := policies[permission]
+	policiesLock.RUnlock()
+
+	for _, policy := range ps {
+		allow, err := policy(c, user)
+		if err != nil || !allow {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func policyPermissionNames() []string {
+	policiesLock.RLock()
+	defer policiesLock.RUnlock()
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	return names
+}
+
+/*
+check the policies of the permissions matched by url and method
+1. the permission of the exact uri and method, as matched by CheckUserPermission
+2. otherwise the patterns of the permissions, as matched by CasbinAuthorizer
+3. no permission with policies matches, allow
+*/
+func checkRoutePolicies(c *gin.Context, db *gorm.DB, user *User, url, method string) (bool, error) {
+	if !hasPolicies() {
+		return true, nil
+	}
+
+	var candidates []*Permission
+	result := db.Where("name IN ?", policyPermissionNames()).Order("id").Find(&candidates)
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	// 1
+	var matched []*Permission
+	for _, p := range candidates {
+		if p.Uri == url && p.Method == method {
+			matched = append(matched, p)
+		}
+	}
+	// 2
+	if len(matched) == 0 {
+		for _, p := range candidates {
+			if p.Uri != "" && p.Method != "" && KeyMatch2(url, p.Uri) && matchAction(method, p.Method) {
+				matched = append(matched, p)
+			}
+		}
+	}
+
+	// 3
+	for _, p := range matched {
+		allow, err := CheckPolicies(c, user, p.Name)
+		if err != nil || !allow {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// OwnerPolicy allow if the ownerField of the record T with primary key c.Param(param) is the current user id
+func OwnerPolicy[T any](param, ownerField string) PolicyFunc {
+	return func(c *gin.Context, user *User) (bool, error) {
+		db := c.MustGet(DbField).(*gorm.DB)
+		return checkRecordField[T](db, c.Param(param), ownerField, user.ID)
+	}
+}
+
+// GroupPolicy allow if the groupField of the record T with primary key c.Param(param) is the current group id
+func GroupPolicy[T any](param, groupField string) PolicyFunc {
+	return func(c *gin.Context, user *User) (bool, error) {
+		group := CurrentGroup(c)
+		if group == nil {
+			return false, nil
+		}
+		db := c.MustGet(DbField).(*gorm.DB)
+		return checkRecordField[T](db, c.Param(param), groupField, group.ID)
+	}
+}
+
+func checkRecordField[T any](db *gorm.DB, key, field string, value uint) (bool, error) {
+	var count int64
+	result := db.Model(new(T)).
+		Where(GetPkColumnName[T](), key).
+		Where(field, value).
+		Count(&count)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return count > 0, nil
+}
@@ -0,0 +1,110 @@
+package rabbit
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type note struct {
+	ID      uint `gorm:"primarykey"`
+	UserID  uint
+	GroupID uint
+}
+
+func TestPolicies(t *testing.T) {
+	db, r, client := initTestClient(t)
+	MakeMigrates(db, &note{})
+	SetValue(db, KEY_API_NEED_AUTH, "true")
+
+	RegisterPolicy("edit note", OwnerPolicy[note]("key", "user_id"))
+	RegisterPolicy("view note", GroupPolicy[note]("key", "group_id"))
+	defer RemovePolicies("edit note")
+	defer RemovePolicies("view note")
+
+	r.GET("/switch/:gid", func(ctx *gin.Context) {
+		gid, _ := strconv.Atoi(ctx.Param("gid"))
+		SwitchGroup(ctx, uint(gid))
+	})
+	ar := r.Group("/api").Use(WithAuthentication(), WithAuthorization("/api"))
+	ar.PATCH("/note/:key", func(ctx *gin.Context) { ctx.JSON(http.StatusOK, true) })
+	ar.GET("/note/:key", func(ctx *gin.Context) { ctx.JSON(http.StatusOK, true) })
+
+	err := client.CallPost("/auth/register", RegisterUserForm{Email: "bob@example.org", Password: "123456"}, nil)
+	assert.Nil(t, err)
+	bob, _ := GetUserByEmail(db, "bob@example.org")
+	alice, _ := CreateUser(db, "alice@example.org", "123456")
+
+	pEdit, _ := SavePermission(db, 0, 0, "edit note", "/note/:key", http.MethodPatch, false)
+	pView, _ := SavePermission(db, 0, 0, "view note", "/note/:key", http.MethodGet, false)
+	role, _ := AddRoleWithPermissions(db, "editor", "EDITOR", []uint{pEdit.ID, pView.ID})
+	AddRoleForUser(db, bob.ID, role.ID)
+
+	group, _ := CreateGroupByUser(db, bob.ID, "team")
+	own := note{UserID: bob.ID, GroupID: group.ID}
+	other := note{UserID: alice.ID, GroupID: group.ID + 1}
+	db.Create(&own)
+	db.Create(&other)
+
+	// owner
+	{
+		err := client.CallPatch(fmt.Sprintf("/api/note/%d", own.ID), nil, nil)
+		assert.Nil(t, err)
+
+		err = client.CallPatch(fmt.Sprintf("/api/note/%d", other.ID), nil, nil)
+		assert.Contains(t, err.Error(), "permission denied")
+	}
+
+	// group
+	{
+		w := client.Get(fmt.Sprintf("/api/note/%d", own.ID))
+		assert.Equal(t, http.StatusForbidden, w.Code) // no current group
+
+		client.Get(fmt.Sprintf("/switch/%d", group.ID))
+
+		w = client.Get(fmt.Sprintf("/api/note/%d", own.ID))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = client.Get(fmt.Sprintf("/api/note/%d", other.ID))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	}
+}
+
+func TestPoliciesWithPatterns(t *testing.T) {
+	db, r, client := initTestClient(t)
+	MakeMigrates(db, &note{})
+	SetValue(db, KEY_API_NEED_AUTH, "true")
+
+	SavePermission(db, 0, 0, "edit note", "/note/:key", "*", false)
+	RegisterPolicy("edit note", OwnerPolicy[note]("key", "user_id"))
+	defer RemovePolicies("edit note")
+
+	// allowed by patterns without the exact permission rows
+	e := NewEnforcer()
+	ar := r.Group("/api").Use(WithAuthentication(), WithAuthorizationBy("/api", &CasbinAuthorizer{Enforcer: e}))
+	ar.PATCH("/note/:key", func(ctx *gin.Context) { ctx.JSON(http.StatusOK, true) })
+	ar.GET("/ping", func(ctx *gin.Context) { ctx.JSON(http.StatusOK, true) })
+
+	err := client.CallPost("/auth/register", RegisterUserForm{Email: "bob@example.org", Password: "123456"}, nil)
+	assert.Nil(t, err)
+	bob, _ := GetUserByEmail(db, "bob@example.org")
+	own := note{UserID: bob.ID}
+	other := note{UserID: bob.ID + 1}
+	db.Create(&own)
+	db.Create(&other)
+	e.LoadPolicyText(fmt.Sprintf("p, role:editor, /note/*, *\np, role:editor, /ping, GET\ng, user:%d, role:editor", bob.ID))
+
+	// no permission with policies
+	w := client.Get("/api/ping")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// policies of the permission matched by pattern
+	err = client.CallPatch(fmt.Sprintf("/api/note/%d", own.ID), nil, nil)
+	assert.Nil(t, err)
+	err = client.CallPatch(fmt.Sprintf("/api/note/%d", other.ID), nil, nil)
+	assert.Contains(t, err.Error(), "permission denied")
+}
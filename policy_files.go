@@ -0,0 +1,391 @@
+package rabbit
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+type PolicyImportMode string
+
+const (
+	// create and update the roles and permissions in policy, keep others
+	PolicyMerge PolicyImportMode = "merge"
+	// make roles, permissions and grants exactly the same as policy,
+	// the roles not in policy are deleted with their members
+	PolicyReplace PolicyImportMode = "replace"
+)
+
+var errPolicyDryRun = errors.New("policy dry run")
+
+// RBACPolicy refer roles and permissions by name, not ID
+type RBACPolicy struct {
+	Permissions []*RBACPermission `json:"permissions" yaml:"permissions"`
+	Roles       []*RBACRole       `json:"roles" yaml:"roles"`
+}
+
+type RBACPermission struct {
+	Name      string            `json:"name" yaml:"name"`
+	Uri       string            `json:"uri,omitempty" yaml:"uri,omitempty"`
+	Method    string            `json:"method,omitempty" yaml:"method,omitempty"`
+	Anonymous bool              `json:"anonymous,omitempty" yaml:"anonymous,omitempty"`
+	Icon      string            `json:"icon,omitempty" yaml:"icon,omitempty"`
+	Order     int               `json:"order,omitempty" yaml:"order,omitempty"`
+	Hidden    bool              `json:"hidden,omitempty" yaml:"hidden,omitempty"`
+	Children  []*RBACPermission `json:"children,omitempty" yaml:"children,omitempty"`
+}
+
+type RBACRole struct {
+	Name        string   `json:"name" yaml:"name"`
+	Label       string   `json:"label,omitempty" yaml:"label,omitempty"`
+	Permissions []string `json:"permissions,omitempty" yaml:"permissions,omitempty"`
+	Deny        []string `json:"deny,omitempty" yaml:"deny,omitempty"`
+}
+
+// PolicyDiff grants are "role:permission", denies are "role:!permission"
+type PolicyDiff struct {
+	CreatedPermissions []string `json:"createdPermissions,omitempty"`
+	UpdatedPermissions []string `json:"updatedPermissions,omitempty"`
+	DeletedPermissions []string `json:"deletedPermissions,omitempty"`
+	CreatedRoles       []string `json:"createdRoles,omitempty"`
+	UpdatedRoles       []string `json:"updatedRoles,omitempty"`
+	DeletedRoles       []string `json:"deletedRoles,omitempty"`
+	Granted            []string `json:"granted,omitempty"`
+	Revoked            []string `json:"revoked,omitempty"`
+}
+
+func (d *PolicyDiff) Empty() bool {
+	return len(d.CreatedPermissions)+len(d.UpdatedPermissions)+len(d.DeletedPermissions)+
+		len(d.CreatedRoles)+len(d.UpdatedRoles)+len(d.DeletedRoles)+
+		len(d.Granted)+len(d.Revoked) == 0
+}
+
+// ExportPolicy export roles, permission tree and grants as yaml
+func ExportPolicy(db *gorm.DB) ([]byte, error) {
+	policy, err := GetPolicy(db)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(policy)
+}
+
+func GetPolicy(db *gorm.DB) (*RBACPolicy, error) {
+	if err := checkPermissionNames(db); err != nil {
+		return nil, err
+	}
+	tree, err := GetPermissionTree(db)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &RBACPolicy{}
+	for _, p := range tree {
+		policy.Permissions = append(policy.Permissions, toRBACPermission(p))
+	}
+
+	var roles []*Role
+	if err := db.Order("name").Find(&roles).Error; err != nil {
+		return nil, err
+	}
+
+	var grants []struct {
+		RoleID uint
+		Name   string
+		Deny   bool
+	}
+	result := db.Table("? AS role_permissions", tableOf(db, &RolePermission{})).
+		Select("role_permissions.role_id, permissions.name, role_permissions.deny").
+		Joins("JOIN ? AS permissions ON permissions.id = role_permissions.permission_id", tableOf(db, &Permission{})).
+		Order("permissions.name").
+		Scan(&grants)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	rbacRoles := map[uint]*RBACRole{}
+	for _, r := range roles {
+		rbacRoles[r.ID] = &RBACRole{Name: r.Name, Label: r.Label}
+		policy.Roles = append(policy.Roles, rbacRoles[r.ID])
+	}
+	for _, g := range grants {
+		r, ok := rbacRoles[g.RoleID]
+		if !ok {
+			continue
+		}
+		if g.Deny {
+			r.Deny = append(r.Deny, g.Name)
+		} else {
+			r.Permissions = append(r.Permissions, g.Name)
+		}
+	}
+	return policy, nil
+}
+
+// policy refer permissions by name, the duplicate names in db can not be resolved
+func checkPermissionNames(db *gorm.DB) error {
+	var names []string
+	result := db.Model(&Permission{}).
+		Group("name").
+		Having("COUNT(*) > 1").
+		Order("name").
+		Pluck("name", &names)
+	if result.Error != nil {
+		return result.Error
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("duplicate permission names in database: %s", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+func toRBACPermission(p *Permission) *RBACPermission {
+	rp := &RBACPermission{
+		Name:      p.Name,
+		Uri:       p.Uri,
+		Method:    p.Method,
+		Anonymous: p.Anonymous,
+		Icon:      p.Icon,
+		Order:     p.Order,
+		Hidden:    p.Hidden,
+	}
+	for _, child := range p.Children {
+		rp.Children = append(rp.Children, toRBACPermission(child))
+	}
+	return rp
+}
+
+// ImportPolicy apply yaml or json policy in a transaction, return the changes
+func ImportPolicy(db *gorm.DB, data []byte, mode PolicyImportMode) (*PolicyDiff, error) {
+	return importPolicy(db, data, mode, false)
+}
+
+// PlanPolicy return the changes of ImportPolicy without applying them
+func PlanPolicy(db *gorm.DB, data []byte, mode PolicyImportMode) (*PolicyDiff, error) {
+	return importPolicy(db, data, mode, true)
+}
+
+func importPolicy(db *gorm.DB, data []byte, mode PolicyImportMode, dryRun bool) (*PolicyDiff, error) {
+	if mode != PolicyMerge && mode != PolicyReplace {
+		return nil, fmt.Errorf("invalid policy import mode: %s", mode)
+	}
+
+	var policy RBACPolicy
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		return nil, err
+	}
+
+	diff := &PolicyDiff{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := applyPolicy(tx, &policy, mode, diff); err != nil {
+			return err
+		}
+		if dryRun {
+			return errPolicyDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errPolicyDryRun) {
+		return nil, err
+	}
+	return diff, nil
+}
+
+/*
+1. create or update permissions, parent by tree
+2. create or update roles
+3. set grants of roles
+4. replace mode: delete the roles and permissions not in policy
+*/
+func applyPolicy(tx *gorm.DB, policy *RBACPolicy, mode PolicyImportMode, diff *PolicyDiff) error {
+	if err := checkPermissionNames(tx); err != nil {
+		return err
+	}
+	var permissions []*Permission
+	if err := tx.Find(&permissions).Error; err != nil {
+		return err
+	}
+	permissionMap := map[string]*Permission{}
+	for _, p := range permissions {
+		permissionMap[p.Name] = p
+	}
+
+	// 1
+	seen := map[string]bool{}
+	var walk func(nodes []*RBACPermission, parentID uint) error
+	walk = func(nodes []*RBACPermission, parentID uint) error {
+		for _, node := range nodes {
+			if node.Name == "" {
+				return errors.New("permission name is required")
+			}
+			if seen[node.Name] {
+				return fmt.Errorf("duplicate permission: %s", node.Name)
+			}
+			seen[node.Name] = true
+
+			p, ok := permissionMap[node.Name]
+			if !ok {
+				p = &Permission{Name: node.Name, ParentID: parentID, Uri: node.Uri, Method: node.Method, Anonymous: node.Anonymous,
+					Icon: node.Icon, Order: node.Order, Hidden: node.Hidden}
+				if err := tx.Create(p).Error; err != nil {
+					return err
+				}
+				permissionMap[p.Name] = p
+				diff.CreatedPermissions = append(diff.CreatedPermissions, p.Name)
+			} else if p.ParentID != parentID || p.Uri != node.Uri || p.Method != node.Method || p.Anonymous != node.Anonymous ||
+				p.Icon != node.Icon || p.Order != node.Order || p.Hidden != node.Hidden {
+				p.ParentID, p.Uri, p.Method, p.Anonymous = parentID, node.Uri, node.Method, node.Anonymous
+				p.Icon, p.Order, p.Hidden = node.Icon, node.Order, node.Hidden
+				result := tx.Model(p).Select("parent_id", "uri", "method", "anonymous", "icon", "sort_order", "hidden").Updates(p)
+				if result.Error != nil {
+					return result.Error
+				}
+				diff.UpdatedPermissions = append(diff.UpdatedPermissions, p.Name)
+			}
+
+			if err := walk(node.Children, p.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(policy.Permissions, 0); err != nil {
+		return err
+	}
+
+	var roles []*Role
+	if err := tx.Find(&roles).Error; err != nil {
+		return err
+	}
+	roleMap := map[string]*Role{}
+	for _, r := range roles {
+		roleMap[r.Name] = r
+	}
+
+	inPolicy := map[string]bool{}
+	for _, rr := range policy.Roles {
+		if rr.Name == "" {
+			return errors.New("role name is required")
+		}
+		if inPolicy[rr.Name] {
+			return fmt.Errorf("duplicate role: %s", rr.Name)
+		}
+		inPolicy[rr.Name] = true
+
+		// 2
+		role, ok := roleMap[rr.Name]
+		if !ok {
+			role = &Role{Name: rr.Name, Label: rr.Label}
+			if err := tx.Create(role).Error; err != nil {
+				return err
+			}
+			diff.CreatedRoles = append(diff.CreatedRoles, role.Name)
+		} else if role.Label != rr.Label {
+			if err := tx.Model(role).Update("label", rr.Label).Error; err != nil {
+				return err
+			}
+			diff.UpdatedRoles = append(diff.UpdatedRoles, role.Name)
+		}
+
+		// 3
+		if err := applyRoleGrants(tx, role, rr, permissionMap, mode, diff); err != nil {
+			return err
+		}
+	}
+
+	if mode != PolicyReplace {
+		return nil
+	}
+
+	// 4
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	for _, r := range roles {
+		if inPolicy[r.Name] {
+			continue
+		}
+		if err := DeleteRole(tx, r.ID); err != nil {
+			return err
+		}
+		diff.DeletedRoles = append(diff.DeletedRoles, r.Name)
+	}
+
+	sort.Slice(permissions, func(i, j int) bool { return permissions[i].Name < permissions[j].Name })
+	for _, p := range permissions {
+		if seen[p.Name] {
+			continue
+		}
+		if err := deletePermissions(tx, []uint{p.ID}); err != nil {
+			return err
+		}
+		diff.DeletedPermissions = append(diff.DeletedPermissions, p.Name)
+	}
+	return nil
+}
+
+func applyRoleGrants(tx *gorm.DB, role *Role, rr *RBACRole, permissionMap map[string]*Permission, mode PolicyImportMode, diff *PolicyDiff) error {
+	var current []RolePermission
+	if err := tx.Where("role_id", role.ID).Find(&current).Error; err != nil {
+		return err
+	}
+	currentMap := map[uint]RolePermission{}
+	for _, rp := range current {
+		currentMap[rp.PermissionID] = rp
+	}
+
+	desired := map[uint]bool{}
+	grant := func(name string, deny bool) error {
+		p, ok := permissionMap[name]
+		if !ok {
+			return fmt.Errorf("unknown permission %s in role %s", name, role.Name)
+		}
+		desired[p.ID] = true
+		if rp, ok := currentMap[p.ID]; ok && rp.Deny == deny {
+			return nil
+		}
+		if err := SetRolePermission(tx, role.ID, p.ID, deny); err != nil {
+			return err
+		}
+		diff.Granted = append(diff.Granted, grantName(role.Name, name, deny))
+		return nil
+	}
+	for _, name := range rr.Permissions {
+		if err := grant(name, false); err != nil {
+			return err
+		}
+	}
+	for _, name := range rr.Deny {
+		if err := grant(name, true); err != nil {
+			return err
+		}
+	}
+
+	if mode != PolicyReplace {
+		return nil
+	}
+
+	names := map[uint]string{}
+	for name, p := range permissionMap {
+		names[p.ID] = name
+	}
+	for _, rp := range current {
+		if desired[rp.PermissionID] {
+			continue
+		}
+		result := tx.Where("role_id = ? AND permission_id = ?", rp.RoleID, rp.PermissionID).Delete(&RolePermission{})
+		if result.Error != nil {
+			return result.Error
+		}
+		diff.Revoked = append(diff.Revoked, grantName(role.Name, names[rp.PermissionID], rp.Deny))
+	}
+	return nil
+}
+
+func grantName(role, permission string, deny bool) string {
+	if deny {
+		return role + ":!" + permission
+	}
+	return role + ":" + permission
+}
@@ -0,0 +1,144 @@
+package rabbit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicy = `
+permissions:
+  - name: user
+    uri: /user
+    children:
+      - name: list user
+        uri: /user
+        method: GET
+      - name: delete user
+        uri: /user/:key
+        method: DELETE
+  - name: ping
+    uri: /ping
+    method: GET
+    anonymous: true
+roles:
+  - name: admin
+    label: ADMIN
+    permissions: [list user, delete user]
+  - name: support
+    label: SUPPORT
+    permissions: [list user]
+    deny: [delete user]
+`
+
+func TestImportExportPolicy(t *testing.T) {
+	db := initDB(t)
+
+	// dry run
+	diff, err := PlanPolicy(db, []byte(testPolicy), PolicyMerge)
+	assert.Nil(t, err)
+	assert.Len(t, diff.CreatedPermissions, 4)
+	assert.Len(t, diff.CreatedRoles, 2)
+	assert.Equal(t, []string{"admin:list user", "admin:delete user", "support:list user", "support:!delete user"}, diff.Granted)
+
+	count, _ := Count[Role](db)
+	assert.Equal(t, 0, count)
+
+	// import
+	diff, err = ImportPolicy(db, []byte(testPolicy), PolicyMerge)
+	assert.Nil(t, err)
+	assert.Len(t, diff.CreatedPermissions, 4)
+
+	support, _ := GetRoleByName(db, "support")
+	pass, _ := CheckRolePermission(db, support.ID, "/user/:key", "DELETE")
+	assert.False(t, pass)
+	p, _ := GetPermissionByName(db, "delete user")
+	parent, _ := GetPermissionByID(db, p.ParentID)
+	assert.Equal(t, "user", parent.Name)
+
+	// idempotent
+	diff, err = ImportPolicy(db, []byte(testPolicy), PolicyReplace)
+	assert.Nil(t, err)
+	assert.True(t, diff.Empty())
+
+	// export and import into another db
+	data, err := ExportPolicy(db)
+	assert.Nil(t, err)
+
+	db2 := initDB(t)
+	_, err = ImportPolicy(db2, data, PolicyReplace)
+	assert.Nil(t, err)
+	data2, _ := ExportPolicy(db2)
+	assert.Equal(t, string(data), string(data2))
+
+	// json is also accepted
+	diff, err = PlanPolicy(db, []byte(`{"roles": [{"name": "guest", "permissions": ["ping"]}]}`), PolicyMerge)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"guest"}, diff.CreatedRoles)
+	assert.Equal(t, []string{"guest:ping"}, diff.Granted)
+
+	// merge keeps others, replace deletes them
+	CreateRole(db, "manual", "MANUAL")
+	SavePermission(db, 0, 0, "manual", "/manual", "GET", false)
+
+	diff, _ = ImportPolicy(db, []byte(testPolicy), PolicyMerge)
+	assert.True(t, diff.Empty())
+
+	diff, err = ImportPolicy(db, []byte(`
+permissions:
+  - name: ping
+    uri: /ping
+    method: GET
+roles:
+  - name: admin
+    label: Administrator
+    permissions: [ping]
+`), PolicyReplace)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"manual", "support"}, diff.DeletedRoles)
+	assert.Equal(t, []string{"admin"}, diff.UpdatedRoles)
+	assert.Equal(t, []string{"ping"}, diff.UpdatedPermissions)
+	assert.Equal(t, []string{"delete user", "list user", "manual", "user"}, diff.DeletedPermissions)
+	assert.Equal(t, []string{"admin:ping"}, diff.Granted)
+	assert.Len(t, diff.Revoked, 2)
+
+	count, _ = Count[Permission](db)
+	assert.Equal(t, 1, count)
+
+	// invalid policy rollback
+	_, err = ImportPolicy(db, []byte(`
+roles:
+  - name: new
+    permissions: [not-exist]
+`), PolicyMerge)
+	assert.Contains(t, err.Error(), "unknown permission not-exist")
+	flag, _ := CheckRoleNameExist(db, "new")
+	assert.False(t, flag)
+
+	_, err = ImportPolicy(db, []byte(testPolicy), "unknown")
+	assert.NotNil(t, err)
+}
+
+type legacyPermission struct {
+	ID   uint `gorm:"primarykey"`
+	Name string
+}
+
+func (legacyPermission) TableName() string {
+	return "permissions"
+}
+
+func TestPolicyWithDuplicatePermissions(t *testing.T) {
+	db := newTestDB(t)
+
+	// the legacy table without unique index
+	err := db.AutoMigrate(&legacyPermission{})
+	assert.Nil(t, err)
+	db.Create(&legacyPermission{Name: "ping"})
+	db.Create(&legacyPermission{Name: "ping"})
+
+	_, err = ExportPolicy(db)
+	assert.ErrorContains(t, err, "duplicate permission names in database: ping")
+	_, err = ImportPolicy(db, []byte(testPolicy), PolicyMerge)
+	assert.ErrorContains(t, err, "duplicate permission names in database: ping")
+}
@@ -1,6 +1,7 @@
 package rabbit
 
 import (
+	"errors"
 	"log"
 
 	"github.com/gin-gonic/gin"
@@ -20,12 +21,24 @@ const ENV_AUTH_PREFIX = "AUTH_PREFIX"
 
 const KEY_USER_NEED_ACTIVATE = "USER_NEED_ACTIVATE"
 const KEY_API_NEED_AUTH = "API_NEED_AUTH"
+const KEY_API_AUTH_SHADOW = "API_AUTH_SHADOW" // log the denials of WithAuthorization without blocking
+
+func init() {
+	err := errors.Join(
+		RegisterSetting(KEY_USER_NEED_ACTIVATE, SettingBool, "false", "user need activation before login", nil),
+		RegisterSetting(KEY_API_NEED_AUTH, SettingBool, "false", "check the permissions of api by WithAuthorization", nil),
+		RegisterSetting(KEY_API_AUTH_SHADOW, SettingBool, "false", "log the denials of WithAuthorization without blocking", nil),
+	)
+	if err != nil {
+		panic(err)
+	}
+}
 
 // InitRabbit start with default middleware and auth handler
 // 1. migrate models
 // 2. gin middleware
 // 3. setup env
-// 4. setup config
+// 4. seed registered settings
 // 5. auth handler
 func InitRabbit(db *gorm.DB, r *gin.Engine) {
 	// 1
@@ -45,8 +58,9 @@ func InitRabbit(db *gorm.DB, r *gin.Engine) {
 	}
 
 	// 4
-	CheckValue(db, KEY_USER_NEED_ACTIVATE, "false")
-	CheckValue(db, KEY_API_NEED_AUTH, "false")
+	if err := SeedSettings(db); err != nil {
+		log.Fatal("seed settings fail: ", err)
+	}
 
 	// 5
 	RegisterAuthenticationHandlers("/auth", db, r)
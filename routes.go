@@ -0,0 +1,215 @@
+package rabbit
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type RouteSyncResult struct {
+	Created []*Permission `json:"created"`
+	Stale   []*Permission `json:"stale"`
+}
+
+var routeNames = map[string]string{}
+var routeNamesLock sync.RWMutex
+
+func routeKey(method, fullPath string) string {
+	return method + " " + fullPath
+}
+
+// SetRouteName set a human readable name for route, used as Permission.Name
+func SetRouteName(method, fullPath, name string) {
+	routeNamesLock.Lock()
+	defer routeNamesLock.Unlock()
+	routeNames[routeKey(method, fullPath)] = name
+}
+
+func GetRouteName(method, fullPath string) string {
+	routeNamesLock.RLock()
+	defer routeNamesLock.RUnlock()
+	return routeNames[routeKey(method, fullPath)]
+}
+
+// NamedRoute register handlers like r.Handle, and remember the name of the route
+func NamedRoute(r gin.IRoutes, method, relativePath, name string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	fullPath := relativePath
+	if g, ok := r.(interface{ BasePath() string }); ok {
+		fullPath = joinRoutePath(g.BasePath(), relativePath)
+	}
+	SetRouteName(method, fullPath, name)
+	return r.Handle(method, relativePath, handlers...)
+}
+
+func joinRoutePath(base, relativePath string) string {
+	if relativePath == "" {
+		return base
+	}
+	p := path.Join(base, relativePath)
+	if strings.HasSuffix(relativePath, "/") && !strings.HasSuffix(p, "/") {
+		return p + "/"
+	}
+	return p
+}
+
+// uri of the route path under prefix, matched on the path segment boundary,
+// "/api" matches "/api" and "/api/user", not "/apiv2/user"
+func routeURI(fullPath, prefix string) (string, bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if !strings.HasPrefix(fullPath, prefix) {
+		return "", false
+	}
+	uri := fullPath[len(prefix):]
+	if uri == "" {
+		return "/", true
+	}
+	if uri[0] != '/' {
+		return "", false
+	}
+	return uri, true
+}
+
+// first static segment of uri, "/role/:key" => "role"
+func routeGroupSegment(uri string) string {
+	seg := strings.SplitN(strings.TrimPrefix(uri, "/"), "/", 2)[0]
+	if seg == "" || seg[0] == ':' || seg[0] == '*' {
+		return ""
+	}
+	return seg
+}
+
+// the group is found by uri, named by the segment, or by the uri if the name is taken
+func getOrCreateRouteGroup(db *gorm.DB, seg string, result *RouteSyncResult) (*Permission, error) {
+	uri := "/" + seg
+
+	var p Permission
+	err := db.Where("uri = ? AND method = ?", uri, "").Take(&p).Error
+	if err == nil {
+		return &p, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	name := seg
+	if exist, err := CheckPermissionNameExist(db, name); err != nil {
+		return nil, err
+	} else if exist {
+		name = uri
+	}
+
+	p = Permission{Name: name, Uri: uri}
+	if err := db.Create(&p).Error; err != nil {
+		return nil, err
+	}
+	result.Created = append(result.Created, &p)
+	return &p, nil
+}
+
+/*
+SyncPermissionsFromRoutes create missing permissions for the routes under prefix, in a transaction
+1. the uri of permission is the route path without prefix, same as WithAuthorization
+2. routes are grouped by the first path segment, "/role" is the parent of "/role/:key"
+3. the name of permission is the route name, default is "METHOD uri"
+4. permissions of routes not registered under prefix are reported as stale,
+the permissions are shared by prefixes, the ones of routes under otherPrefixes are not stale
+*/
+func SyncPermissionsFromRoutes(db *gorm.DB, engine *gin.Engine, prefix string, otherPrefixes ...string) (*RouteSyncResult, error) {
+	result := &RouteSyncResult{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return syncPermissionsFromRoutes(tx, engine.Routes(), prefix, otherPrefixes, result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func syncPermissionsFromRoutes(tx *gorm.DB, routes gin.RoutesInfo, prefix string, otherPrefixes []string, result *RouteSyncResult) error {
+	active := map[string]bool{}
+	others := map[string]bool{}
+	groups := map[string]*Permission{}
+
+	for _, route := range routes {
+		for _, other := range otherPrefixes {
+			if uri, ok := routeURI(route.Path, other); ok {
+				others[routeKey(route.Method, uri)] = true
+			}
+		}
+
+		// 1
+		uri, ok := routeURI(route.Path, prefix)
+		if !ok {
+			continue
+		}
+		active[routeKey(route.Method, uri)] = true
+
+		_, err := GetPermission(tx, uri, route.Method)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		// 2
+		var parentID uint
+		if seg := routeGroupSegment(uri); seg != "" {
+			group, ok := groups[seg]
+			if !ok {
+				if group, err = getOrCreateRouteGroup(tx, seg, result); err != nil {
+					return err
+				}
+				groups[seg] = group
+			}
+			parentID = group.ID
+		}
+
+		// 3
+		name := GetRouteName(route.Method, route.Path)
+		if name == "" {
+			name = routeKey(route.Method, uri)
+		} else if exist, err := CheckPermissionNameExist(tx, name); err != nil {
+			return err
+		} else if exist {
+			name = routeKey(route.Method, uri)
+		}
+
+		p, err := SavePermission(tx, 0, parentID, name, uri, route.Method, false)
+		if err != nil {
+			return err
+		}
+		result.Created = append(result.Created, p)
+	}
+
+	// 4
+	var ps []*Permission
+	if err := tx.Where("method <> ?", "").Order("id").Find(&ps).Error; err != nil {
+		return err
+	}
+	for _, p := range ps {
+		key := routeKey(p.Method, p.Uri)
+		if !active[key] && !others[key] {
+			result.Stale = append(result.Stale, p)
+		}
+	}
+	return nil
+}
+
+// PruneStalePermissions delete the stale permissions reported by SyncPermissionsFromRoutes
+func PruneStalePermissions(db *gorm.DB, stale []*Permission) error {
+	if len(stale) == 0 {
+		return nil
+	}
+	ids := make([]uint, 0, len(stale))
+	for _, p := range stale {
+		ids = append(ids, p.ID)
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		return deletePermissions(tx, ids)
+	})
+}
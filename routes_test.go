@@ -0,0 +1,127 @@
+package rabbit
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncPermissionsFromRoutes(t *testing.T) {
+	db := initDB(t)
+
+	r := gin.New()
+	ar := r.Group("/api")
+	RegisterAuthorizationHandlers(db, ar)
+	ar.GET("/ping", func(ctx *gin.Context) {})
+	r.GET("/outside", func(ctx *gin.Context) {})
+	r.GET("/apiv2/orders", func(ctx *gin.Context) {})
+
+	res, err := SyncPermissionsFromRoutes(db, r, "/api")
+	assert.Nil(t, err)
+	assert.Len(t, res.Created, 23) // 18 routes + 5 groups
+	assert.Len(t, res.Stale, 0)
+
+	p, err := GetPermission(db, "/role/:key", http.MethodPatch)
+	assert.Nil(t, err)
+	assert.Equal(t, "update role", p.Name)
+
+	group, err := GetPermissionByID(db, p.ParentID)
+	assert.Nil(t, err)
+	assert.Equal(t, "role", group.Name)
+	assert.Equal(t, "/role", group.Uri)
+
+	children, err := GetPermissionChildren(db, group.ID)
+	assert.Nil(t, err)
+	assert.Len(t, children, 7)
+
+	p, err = GetPermission(db, "/ping", http.MethodGet)
+	assert.Nil(t, err)
+	assert.Equal(t, "GET /ping", p.Name)
+
+	_, err = GetPermission(db, "/outside", http.MethodGet)
+	assert.NotNil(t, err)
+	_, err = GetPermission(db, "v2/orders", http.MethodGet)
+	assert.NotNil(t, err)
+
+	// idempotent
+	res, err = SyncPermissionsFromRoutes(db, r, "/api")
+	assert.Nil(t, err)
+	assert.Len(t, res.Created, 0)
+	assert.Len(t, res.Stale, 0)
+
+	// stale
+	{
+		stale, _ := SavePermission(db, 0, 0, "removed", "/removed", http.MethodGet, false)
+		role, _ := AddRoleWithPermissions(db, "admin", "ADMIN", []uint{stale.ID})
+
+		res, err = SyncPermissionsFromRoutes(db, r, "/api")
+		assert.Nil(t, err)
+		assert.Len(t, res.Stale, 1)
+		assert.Equal(t, stale.ID, res.Stale[0].ID)
+
+		err = PruneStalePermissions(db, res.Stale)
+		assert.Nil(t, err)
+
+		flag, _ := CheckPermissionNameExist(db, "removed")
+		assert.False(t, flag)
+		ps, _ := GetPermissionsByRole(db, role.ID)
+		assert.Len(t, ps, 0)
+	}
+}
+
+func TestSyncPermissionsWithPrefixes(t *testing.T) {
+	db := initDB(t)
+
+	r := gin.New()
+	r.GET("/api/user", func(ctx *gin.Context) {})
+	r.GET("/admin/dashboard", func(ctx *gin.Context) {})
+
+	res, err := SyncPermissionsFromRoutes(db, r, "/api")
+	assert.Nil(t, err)
+	assert.Len(t, res.Created, 2)
+
+	// the permissions of routes under other prefixes are not stale
+	res, err = SyncPermissionsFromRoutes(db, r, "/admin/", "/api")
+	assert.Nil(t, err)
+	assert.Len(t, res.Created, 2)
+	assert.Len(t, res.Stale, 0)
+
+	res, err = SyncPermissionsFromRoutes(db, r, "/api", "/admin")
+	assert.Nil(t, err)
+	assert.Len(t, res.Stale, 0)
+
+	// other prefixes are matched on the segment boundary
+	r.GET("/api/v2/user", func(ctx *gin.Context) {})
+	res, err = SyncPermissionsFromRoutes(db, r, "/admin", "/ap")
+	assert.Nil(t, err)
+	assert.Len(t, res.Stale, 1)
+	assert.Equal(t, "/user", res.Stale[0].Uri)
+
+	// not in scope without other prefixes
+	res, err = SyncPermissionsFromRoutes(db, r, "/api")
+	assert.Nil(t, err)
+	assert.Len(t, res.Stale, 1)
+	assert.Equal(t, "/dashboard", res.Stale[0].Uri)
+
+	// the group name is taken
+	SavePermission(db, 0, 0, "order", "", "", false)
+	r.GET("/api/order/:key", func(ctx *gin.Context) {})
+	res, err = SyncPermissionsFromRoutes(db, r, "/api", "/admin")
+	assert.Nil(t, err)
+	group, err := GetPermission(db, "/order", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "/order", group.Name)
+
+	// rollback
+	var before, after int64
+	db.Model(&Permission{}).Count(&before)
+	r.GET("/api/invoice", func(ctx *gin.Context) {})
+	restore := injectFailure(db, "permissions")
+	_, err = SyncPermissionsFromRoutes(db, r, "/api")
+	restore()
+	assert.NotNil(t, err)
+	db.Model(&Permission{}).Count(&after)
+	assert.Equal(t, before, after)
+}
@@ -0,0 +1,250 @@
+package rabbit
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// ENV_SECRET_KEYS is the keys of secret values, "id:key" separated by comma,
+// the first one is used to encrypt, others are used to decrypt the values not rotated yet
+const ENV_SECRET_KEYS = "SECRET_KEYS"
+
+// RedactedValue replace the secret values in config listings
+const RedactedValue = "******"
+
+// encrypted value: enc:<key id>:<base64 of nonce and ciphertext>
+const secretValuePrefix = "enc:"
+
+var ErrSecretConfig = errors.New("config is secret, use SetSecretValue")
+
+func isSecretValue(value string) bool {
+	return strings.HasPrefix(value, secretValuePrefix)
+}
+
+// parse ENV_SECRET_KEYS, the key is sha256 of the text, AES-256
+func loadSecretKeys() (current string, keys map[string][]byte, err error) {
+	keys = map[string][]byte{}
+	for _, item := range strings.Split(GetEnv(ENV_SECRET_KEYS), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		id, text, ok := strings.Cut(item, ":")
+		if !ok || id == "" || text == "" {
+			return "", nil, fmt.Errorf("invalid %s, must be id:key", ENV_SECRET_KEYS)
+		}
+		sum := sha256.Sum256([]byte(text))
+		keys[id] = sum[:]
+		if current == "" {
+			current = id
+		}
+	}
+	if current == "" {
+		return "", nil, fmt.Errorf("%s not set", ENV_SECRET_KEYS)
+	}
+	return current, keys, nil
+}
+
+// EncryptSecret encrypt value with AES-GCM by the current key, the config key is the additional data
+func EncryptSecret(key, value string) (string, error) {
+	id, keys, err := loadSecretKeys()
+	if err != nil {
+		return "", err
+	}
+	return encryptSecret(id, keys[id], key, value)
+}
+
+func encryptSecret(id string, secretKey []byte, key, value string) (string, error) {
+	gcm, err := newGCM(secretKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), []byte(strings.ToUpper(key)))
+	return secretValuePrefix + id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptSecret decrypt the value of EncryptSecret, by the key id in value
+func DecryptSecret(key, value string) (string, error) {
+	_, keys, err := loadSecretKeys()
+	if err != nil {
+		return "", err
+	}
+	id, _, err := parseSecretValue(value)
+	if err != nil {
+		return "", err
+	}
+	secretKey, ok := keys[id]
+	if !ok {
+		return "", fmt.Errorf("secret key %s not found", id)
+	}
+	return decryptSecret(secretKey, key, value)
+}
+
+func decryptSecret(secretKey []byte, key, value string) (string, error) {
+	_, sealed, err := parseSecretValue(value)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(secretKey)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("invalid secret value")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, ciphertext, []byte(strings.ToUpper(key)))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func parseSecretValue(value string) (id string, sealed []byte, err error) {
+	if !isSecretValue(value) {
+		return "", nil, errors.New("not a secret value")
+	}
+	id, data, ok := strings.Cut(value[len(secretValuePrefix):], ":")
+	if !ok {
+		return "", nil, errors.New("invalid secret value")
+	}
+	sealed, err = base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, sealed, nil
+}
+
+func newGCM(secretKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SetSecretValue encrypt and set the value of key, the config is marked as secret
+func SetSecretValue(db *gorm.DB, key, value string) error {
+	key = strings.ToUpper(key)
+
+	if err := ValidateSetting(key, value); err != nil {
+		return err
+	}
+	encrypted, err := EncryptSecret(key, value)
+	if err != nil {
+		return err
+	}
+	return writeValue(db, key, encrypted, true)
+}
+
+// GetSecretValue return the decrypted value of key, empty if key not exists
+func GetSecretValue(db *gorm.DB, key string) (string, error) {
+	key = strings.ToUpper(key)
+
+	value := GetValue(db, key)
+	if value == "" {
+		return "", nil
+	}
+	plain, err := DecryptSecret(key, value)
+	if err != nil {
+		return "", fmt.Errorf("decrypt config %s fail: %w", key, err)
+	}
+	return plain, nil
+}
+
+/*
+RotateSecretValues re-encrypt the secret values by the current key in a transaction
+1. secret configs encrypted by other keys
+2. secret values in ConfigHistory, so they can still be rolled back
+*/
+func RotateSecretValues(db *gorm.DB) (int, error) {
+	current, keys, err := loadSecretKeys()
+	if err != nil {
+		return 0, err
+	}
+
+	rotate := func(key, value string) (string, bool, error) {
+		id, _, err := parseSecretValue(value)
+		if err != nil || id == current {
+			return value, false, nil
+		}
+		secretKey, ok := keys[id]
+		if !ok {
+			return "", false, fmt.Errorf("secret key %s of config %s not found", id, key)
+		}
+		plain, err := decryptSecret(secretKey, key, value)
+		if err != nil {
+			return "", false, fmt.Errorf("decrypt config %s fail: %w", key, err)
+		}
+		value, err = encryptSecret(current, keys[current], key, plain)
+		return value, err == nil, err
+	}
+
+	count := 0
+	err = ConfigTransaction(db, func(tx *gorm.DB) error {
+		// 1
+		var configs []Config
+		if err := tx.Where("secret", true).Order("id").Find(&configs).Error; err != nil {
+			return err
+		}
+		secretKeys := make([]string, 0, len(configs))
+		for _, c := range configs {
+			secretKeys = append(secretKeys, c.Key)
+			value, changed, err := rotate(c.Key, c.Value)
+			if err != nil {
+				return err
+			}
+			if !changed {
+				continue
+			}
+			if err := writeValue(tx, c.Key, value, true); err != nil {
+				return err
+			}
+			count++
+		}
+
+		// 2
+		if len(secretKeys) == 0 {
+			return nil
+		}
+		var history []ConfigHistory
+		if err := tx.Where("key", secretKeys).Order("id").Find(&history).Error; err != nil {
+			return err
+		}
+		for _, h := range history {
+			oldValue, oldChanged, err := rotate(h.Key, h.OldValue)
+			if err != nil {
+				return err
+			}
+			newValue, newChanged, err := rotate(h.Key, h.NewValue)
+			if err != nil {
+				return err
+			}
+			if !oldChanged && !newChanged {
+				continue
+			}
+			result := tx.Model(&ConfigHistory{}).Where("id", h.ID).
+				Updates(map[string]any{"old_value": oldValue, "new_value": newValue})
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
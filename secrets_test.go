@@ -0,0 +1,122 @@
+package rabbit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretValues(t *testing.T) {
+	db := initDB(t)
+
+	t.Setenv(ENV_SECRET_KEYS, "")
+	err := SetSecretValue(db, "smtp_password", "p@ss")
+	assert.NotNil(t, err)
+
+	t.Setenv(ENV_SECRET_KEYS, "k1:first secret")
+	err = SetSecretValue(db, "smtp_password", "p@ss")
+	assert.Nil(t, err)
+
+	raw := GetValue(db, "smtp_password")
+	assert.NotContains(t, raw, "p@ss")
+	assert.Contains(t, raw, "enc:k1:")
+
+	v, err := GetSecretValue(db, "smtp_password")
+	assert.Nil(t, err)
+	assert.Equal(t, "p@ss", v)
+
+	v, err = GetSecretValue(db, "not_exist")
+	assert.Nil(t, err)
+	assert.Empty(t, v)
+
+	// bound to the key
+	SetValue(db, "other", raw)
+	_, err = GetSecretValue(db, "other")
+	assert.NotNil(t, err)
+
+	// secret can not be overwritten as plaintext
+	err = SetValue(db, "smtp_password", "plain")
+	assert.ErrorIs(t, err, ErrSecretConfig)
+
+	// redacted in listings
+	items, err := ListConfigs(db)
+	assert.Nil(t, err)
+	for _, item := range items {
+		if item.Key == "SMTP_PASSWORD" {
+			assert.True(t, item.Secret)
+			assert.Equal(t, RedactedValue, item.Value)
+		}
+	}
+
+	changes, err := UpdateValues(db, map[string]string{"smtp_password": "new p@ss"}, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, RedactedValue, changes[0].NewValue)
+	v, _ = GetSecretValue(db, "smtp_password")
+	assert.Equal(t, "new p@ss", v)
+
+	// the redacted value posted back is unchanged
+	changes, err = UpdateValues(db, map[string]string{"smtp_password": RedactedValue}, 1)
+	assert.Nil(t, err)
+	assert.Empty(t, changes)
+	v, _ = GetSecretValue(db, "smtp_password")
+	assert.Equal(t, "new p@ss", v)
+
+	history, err := GetConfigHistory(db, "smtp_password", 10)
+	assert.Nil(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, RedactedValue, history[0].OldValue)
+
+	// rotate
+	t.Setenv(ENV_SECRET_KEYS, "k2:second secret,k1:first secret")
+	count, err := RotateSecretValues(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	assert.Contains(t, GetValue(db, "smtp_password"), "enc:k2:")
+
+	t.Setenv(ENV_SECRET_KEYS, "k2:second secret")
+	v, err = GetSecretValue(db, "smtp_password")
+	assert.Nil(t, err)
+	assert.Equal(t, "new p@ss", v)
+
+	// rollback by the rotated history
+	_, err = RollbackValue(db, "smtp_password", 0, 1)
+	assert.Nil(t, err)
+	v, err = GetSecretValue(db, "smtp_password")
+	assert.Nil(t, err)
+	assert.Equal(t, "p@ss", v)
+
+	count, err = RotateSecretValues(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestTypedSecretValues(t *testing.T) {
+	db := initDB(t)
+	t.Setenv(ENV_SECRET_KEYS, "k1:first secret")
+
+	err := RegisterSetting("test_smtp_port", SettingInt, "25", "smtp port", nil)
+	assert.Nil(t, err)
+	defer func() {
+		settingsLock.Lock()
+		defer settingsLock.Unlock()
+		delete(settings, "TEST_SMTP_PORT")
+	}()
+
+	err = SetSecretValue(db, "test_smtp_port", "465")
+	assert.Nil(t, err)
+	_, err = UpdateValues(db, map[string]string{"test_smtp_port": "587"}, 1)
+	assert.Nil(t, err)
+
+	// the encrypted value in history is validated by the plaintext
+	_, err = RollbackValue(db, "test_smtp_port", 0, 1)
+	assert.Nil(t, err)
+	v, _ := GetSecretValue(db, "test_smtp_port")
+	assert.Equal(t, "465", v)
+
+	// the ciphertext of other key is invalid
+	other, _ := EncryptSecret("other", "587")
+	_, err = UpdateValues(db, map[string]string{"test_smtp_port": other}, 1)
+	assert.ErrorIs(t, err, ErrInvalidSetting)
+	v, _ = GetSecretValue(db, "test_smtp_port")
+	assert.Equal(t, "465", v)
+}
@@ -0,0 +1,181 @@
+package rabbit
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SettingDecoder decode the raw value of a field by LoadSettings,
+// encoding.TextUnmarshaler is also accepted
+type SettingDecoder interface {
+	DecodeSetting(value string) error
+}
+
+// MissingSettingsError list all the required settings not set
+type MissingSettingsError struct {
+	Keys []string
+}
+
+func (e *MissingSettingsError) Error() string {
+	return "missing required settings: " + strings.Join(e.Keys, ", ")
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+/*
+LoadSettings fill the struct pointed by dst with the tags of fields
+
+	env:"DSN"               key in env, .env and Config table
+	default:"file::memory:" used if the key is not set
+	required:"true"         the key must be set or have a default
+	prefix:"DB_"            prefix of the keys in nested struct
+
+1. value from process env > .env > Config table (db may be nil) > default
+2. nested structs without env tag are loaded recursively
+3. all missing required keys are reported at once by MissingSettingsError, joined with the invalid values
+*/
+func LoadSettings(db *gorm.DB, dst any) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("LoadSettings need a pointer to struct, got %T", dst)
+	}
+
+	missing := &MissingSettingsError{}
+	errs := loadSettingFields(db, rv.Elem(), "", missing)
+	// 3
+	if len(missing.Keys) > 0 {
+		errs = append([]error{missing}, errs...)
+	}
+	return errors.Join(errs...)
+}
+
+func loadSettingFields(db *gorm.DB, rv reflect.Value, prefix string, missing *MissingSettingsError) []error {
+	var errs []error
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		fv := rv.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		key, ok := field.Tag.Lookup("env")
+		if !ok {
+			// 2
+			if fv.Kind() == reflect.Pointer && fv.Type().Elem().Kind() == reflect.Struct {
+				if fv.IsNil() {
+					fv.Set(reflect.New(fv.Type().Elem()))
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				errs = append(errs, loadSettingFields(db, fv, prefix+field.Tag.Get("prefix"), missing)...)
+			}
+			continue
+		}
+		key = prefix + key
+
+		// 1
+		value := lookupSetting(db, key)
+		if value == "" {
+			value = field.Tag.Get("default")
+		}
+		if value == "" {
+			if required, _ := strconv.ParseBool(field.Tag.Get("required")); required {
+				missing.Keys = append(missing.Keys, key)
+			}
+			continue
+		}
+
+		if err := decodeSetting(fv, value); err != nil {
+			errs = append(errs, fmt.Errorf("%w %s: %w", ErrInvalidSetting, key, err))
+		}
+	}
+	return errs
+}
+
+func lookupSetting(db *gorm.DB, key string) string {
+	if v, ok := LookupEnv(key); ok && v != "" {
+		return v
+	}
+	if db == nil {
+		return ""
+	}
+	return GetValue(db, key)
+}
+
+// decode value into v by SettingDecoder, TextUnmarshaler or the kind of v, slices are comma separated
+func decodeSetting(v reflect.Value, value string) error {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decodeSetting(v.Elem(), value)
+	}
+
+	if v.CanAddr() {
+		switch d := v.Addr().Interface().(type) {
+		case SettingDecoder:
+			return d.DecodeSetting(value)
+		case encoding.TextUnmarshaler:
+			return d.UnmarshalText([]byte(value))
+		}
+	}
+
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		items := splitStringList(value)
+		slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := decodeSetting(slice.Index(i), item); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
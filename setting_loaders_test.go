@@ -0,0 +1,103 @@
+package rabbit
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type logLevel int
+
+func (l *logLevel) DecodeSetting(value string) error {
+	switch strings.ToLower(value) {
+	case "debug":
+		*l = 0
+	case "info":
+		*l = 1
+	default:
+		return errors.New("unknown level " + value)
+	}
+	return nil
+}
+
+type testDBSettings struct {
+	DSN     string        `env:"DSN" default:"file::memory:"`
+	MaxOpen int           `env:"MAX_OPEN" default:"10"`
+	Timeout time.Duration `env:"TIMEOUT" default:"5s"`
+}
+
+type testAppSettings struct {
+	Name   string   `env:"TEST_APP_NAME" required:"true"`
+	Debug  bool     `env:"TEST_APP_DEBUG"`
+	Hosts  []string `env:"TEST_APP_HOSTS" default:"a.com, b.com"`
+	Ports  []int    `env:"TEST_APP_PORTS"`
+	Level  logLevel `env:"TEST_APP_LEVEL" default:"debug"`
+	Bind   net.IP   `env:"TEST_APP_BIND"`
+	Ratio  *float64 `env:"TEST_APP_RATIO"`
+	Secret string   `env:"TEST_APP_SECRET" required:"true"`
+
+	DB      testDBSettings  `prefix:"TEST_DB_"`
+	Replica *testDBSettings `prefix:"TEST_REPLICA_"`
+
+	ignored string
+}
+
+func TestLoadSettings(t *testing.T) {
+	db := initDB(t)
+
+	// all missing required keys
+	var cfg testAppSettings
+	err := LoadSettings(db, &cfg)
+	var missing *MissingSettingsError
+	assert.ErrorAs(t, err, &missing)
+	assert.Equal(t, []string{"TEST_APP_NAME", "TEST_APP_SECRET"}, missing.Keys)
+
+	// env > Config table > default
+	t.Setenv("TEST_APP_NAME", "rabbit")
+	t.Setenv("TEST_APP_PORTS", "80,443")
+	t.Setenv("TEST_APP_LEVEL", "INFO")
+	t.Setenv("TEST_APP_BIND", "127.0.0.1")
+	t.Setenv("TEST_DB_TIMEOUT", "1m")
+	SetValue(db, "TEST_APP_NAME", "from-db")
+	SetValue(db, "TEST_APP_SECRET", "s3cret")
+	SetValue(db, "TEST_APP_RATIO", "0.5")
+	SetValue(db, "TEST_REPLICA_DSN", "replica.db")
+
+	cfg = testAppSettings{}
+	err = LoadSettings(db, &cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, "rabbit", cfg.Name)
+	assert.Equal(t, "s3cret", cfg.Secret)
+	assert.False(t, cfg.Debug)
+	assert.Equal(t, []string{"a.com", "b.com"}, cfg.Hosts)
+	assert.Equal(t, []int{80, 443}, cfg.Ports)
+	assert.Equal(t, logLevel(1), cfg.Level)
+	assert.Equal(t, "127.0.0.1", cfg.Bind.String())
+	assert.Equal(t, 0.5, *cfg.Ratio)
+	assert.Equal(t, testDBSettings{DSN: "file::memory:", MaxOpen: 10, Timeout: time.Minute}, cfg.DB)
+	assert.Equal(t, "replica.db", cfg.Replica.DSN)
+
+	// invalid values are reported with the keys
+	t.Setenv("TEST_APP_PORTS", "80,x")
+	t.Setenv("TEST_APP_LEVEL", "trace")
+	t.Setenv("TEST_APP_SECRET", "")
+	SetValue(db, "TEST_APP_SECRET", "")
+	err = LoadSettings(db, &cfg)
+	assert.ErrorIs(t, err, ErrInvalidSetting)
+	assert.ErrorAs(t, err, &missing)
+	assert.Equal(t, []string{"TEST_APP_SECRET"}, missing.Keys)
+	assert.Contains(t, err.Error(), "TEST_APP_PORTS")
+	assert.Contains(t, err.Error(), "TEST_APP_LEVEL")
+
+	// env only
+	var dbCfg testDBSettings
+	err = LoadSettings(nil, &dbCfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, dbCfg.MaxOpen)
+
+	assert.NotNil(t, LoadSettings(db, cfg))
+}
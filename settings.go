@@ -0,0 +1,206 @@
+package rabbit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type SettingType string
+
+const (
+	SettingString     SettingType = "string"
+	SettingBool       SettingType = "bool"
+	SettingInt        SettingType = "int"
+	SettingDuration   SettingType = "duration"    // time.ParseDuration, e.g. 1h30m
+	SettingStringList SettingType = "string_list" // comma separated
+	SettingJSON       SettingType = "json"
+)
+
+// SettingValidator check the parsed value of setting, e.g. int, time.Duration, []string
+type SettingValidator func(value any) error
+
+// Setting is a typed Config, the value is still stored as string
+type Setting struct {
+	Key       string           `json:"key"`
+	Type      SettingType      `json:"type"`
+	Default   string           `json:"default"`
+	Desc      string           `json:"desc"`
+	Validator SettingValidator `json:"-"`
+}
+
+// ErrInvalidSetting is wrapped by the validation errors of SetValue
+var ErrInvalidSetting = errors.New("invalid value of setting")
+
+var settings = map[string]*Setting{}
+var settingsLock sync.RWMutex
+
+// RegisterSetting register a typed setting, the default value must be valid.
+// the missing settings are created with default value and desc by SeedSettings
+func RegisterSetting(key string, typ SettingType, defaultValue, desc string, validator SettingValidator) error {
+	s := &Setting{
+		Key:       strings.ToUpper(key),
+		Type:      typ,
+		Default:   defaultValue,
+		Desc:      desc,
+		Validator: validator,
+	}
+	if _, err := s.Parse(defaultValue); err != nil {
+		return fmt.Errorf("invalid default of setting %s: %w", s.Key, err)
+	}
+
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	settings[s.Key] = s
+	return nil
+}
+
+func GetRegisteredSetting(key string) (*Setting, bool) {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	s, ok := settings[strings.ToUpper(key)]
+	return s, ok
+}
+
+// ListSettings return the registered settings sorted by key
+func ListSettings() []*Setting {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+
+	items := make([]*Setting, 0, len(settings))
+	for _, s := range settings {
+		items = append(items, s)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	return items
+}
+
+// Parse parse value by type and check by validator,
+// json value is parsed as json.RawMessage
+func (s *Setting) Parse(value string) (any, error) {
+	var v any
+	var err error
+	switch s.Type {
+	case SettingString:
+		v = value
+	case SettingBool:
+		v, err = strconv.ParseBool(value)
+	case SettingInt:
+		v, err = strconv.Atoi(value)
+	case SettingDuration:
+		v, err = time.ParseDuration(value)
+	case SettingStringList:
+		v = splitStringList(value)
+	case SettingJSON:
+		if !json.Valid([]byte(value)) {
+			err = fmt.Errorf("invalid json: %s", value)
+		}
+		v = json.RawMessage(value)
+	default:
+		err = fmt.Errorf("unknown setting type: %s", s.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Validator != nil {
+		if err := s.Validator(v); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+func splitStringList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ValidateSetting check the value of registered setting, not registered keys are valid
+func ValidateSetting(key, value string) error {
+	s, ok := GetRegisteredSetting(key)
+	if !ok {
+		return nil
+	}
+	if _, err := s.Parse(value); err != nil {
+		return fmt.Errorf("%w %s: %w", ErrInvalidSetting, s.Key, err)
+	}
+	return nil
+}
+
+/*
+GetSetting return the typed value of registered setting
+1. the default value is used if the key not exists or empty
+2. T is bool, int, time.Duration, []string or string by type, json is unmarshaled to T
+3. parse errors are reported, not ignored
+*/
+func GetSetting[T any](db *gorm.DB, key string) (T, error) {
+	var zero T
+	s, ok := GetRegisteredSetting(key)
+	if !ok {
+		return zero, fmt.Errorf("setting %s not registered", strings.ToUpper(key))
+	}
+
+	// 1
+	value := GetValue(db, s.Key)
+	if value == "" {
+		value = s.Default
+	}
+
+	// 3
+	v, err := s.Parse(value)
+	if err != nil {
+		return zero, fmt.Errorf("invalid value of setting %s: %w", s.Key, err)
+	}
+
+	// 2
+	if s.Type == SettingJSON {
+		var result T
+		if err := json.Unmarshal(v.(json.RawMessage), &result); err != nil {
+			return zero, fmt.Errorf("invalid value of setting %s: %w", s.Key, err)
+		}
+		return result, nil
+	}
+	result, ok := v.(T)
+	if !ok {
+		return zero, fmt.Errorf("setting %s is %s, can not be %T", s.Key, s.Type, zero)
+	}
+	return result, nil
+}
+
+// SeedSettings create the missing registered settings with default value, and fill the empty desc
+func SeedSettings(db *gorm.DB) error {
+	for _, s := range ListSettings() {
+		var count int64
+		if err := db.Model(&Config{}).Where("key", s.Key).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			if err := SetValue(db, s.Key, s.Default); err != nil {
+				return err
+			}
+		}
+		desc := clause.Column{Name: "desc"}
+		result := db.Model(&Config{}).
+			Where("key", s.Key).
+			Where(clause.Or(clause.Eq{Column: desc, Value: ""}, clause.Eq{Column: desc, Value: nil})).
+			Update("desc", s.Desc)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
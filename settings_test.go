@@ -0,0 +1,103 @@
+package rabbit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSettings(t *testing.T) {
+	db := initDB(t)
+
+	err := RegisterSetting("test_retry", SettingInt, "3", "retry times", func(value any) error {
+		if value.(int) < 0 {
+			return errors.New("must not be negative")
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	err = RegisterSetting("test_timeout", SettingDuration, "5s", "request timeout", nil)
+	assert.Nil(t, err)
+	err = RegisterSetting("test_hosts", SettingStringList, "a.com, b.com", "allowed hosts", nil)
+	assert.Nil(t, err)
+	err = RegisterSetting("test_limits", SettingJSON, `{"max": 10}`, "rate limits", nil)
+	assert.Nil(t, err)
+	err = RegisterSetting("test_invalid", SettingBool, "maybe", "", nil)
+	assert.NotNil(t, err)
+
+	defer func() {
+		settingsLock.Lock()
+		defer settingsLock.Unlock()
+		for _, key := range []string{"TEST_RETRY", "TEST_TIMEOUT", "TEST_HOSTS", "TEST_LIMITS"} {
+			delete(settings, key)
+		}
+	}()
+
+	// seed
+	SetValue(db, KEY_API_NEED_AUTH, "true")
+	err = SeedSettings(db)
+	assert.Nil(t, err)
+	assert.Equal(t, "3", GetValue(db, "test_retry"))
+	assert.True(t, GetBoolValue(db, KEY_API_NEED_AUTH))
+
+	var c Config
+	db.Where("key", "TEST_TIMEOUT").Take(&c)
+	assert.Equal(t, "request timeout", c.Desc)
+	db.Where("key", KEY_API_NEED_AUTH).Take(&c)
+	assert.NotEmpty(t, c.Desc)
+
+	// typed getters
+	retry, err := GetSetting[int](db, "test_retry")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, retry)
+
+	timeout, err := GetSetting[time.Duration](db, "test_timeout")
+	assert.Nil(t, err)
+	assert.Equal(t, 5*time.Second, timeout)
+
+	hosts, err := GetSetting[[]string](db, "test_hosts")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.com", "b.com"}, hosts)
+
+	limits, err := GetSetting[struct{ Max int }](db, "test_limits")
+	assert.Nil(t, err)
+	assert.Equal(t, 10, limits.Max)
+
+	needAuth, err := GetSetting[bool](db, KEY_API_NEED_AUTH)
+	assert.Nil(t, err)
+	assert.True(t, needAuth)
+
+	_, err = GetSetting[string](db, "test_retry")
+	assert.NotNil(t, err)
+	_, err = GetSetting[int](db, "not_registered")
+	assert.NotNil(t, err)
+
+	// validate writes
+	assert.NotNil(t, SetValue(db, "test_retry", "-1"))
+	assert.NotNil(t, SetValue(db, "test_retry", "abc"))
+	assert.NotNil(t, SetValue(db, "test_timeout", "5"))
+	assert.NotNil(t, SetValue(db, "test_limits", "{"))
+	assert.Nil(t, SetValue(db, "test_retry", "5"))
+	retry, _ = GetSetting[int](db, "test_retry")
+	assert.Equal(t, 5, retry)
+
+	// parse errors are reported
+	db.Model(&Config{}).Where("key", KEY_API_NEED_AUTH).UpdateColumn("value", "yes")
+	_, err = GetSetting[bool](db, KEY_API_NEED_AUTH)
+	assert.NotNil(t, err)
+
+	// the registered default is used by the untyped getters
+	db.Model(&Config{}).Where("key", "TEST_RETRY").UpdateColumn("value", "")
+	assert.Equal(t, 3, GetIntValue(db, "test_retry", -1))
+	db.Model(&Config{}).Where("key", "TEST_RETRY").UpdateColumn("value", "abc")
+	assert.Equal(t, -1, GetIntValue(db, "test_retry", -1))
+
+	// the invalid default of CheckValue is reported
+	db.Model(&Config{}).Where("key", "TEST_RETRY").UpdateColumn("value", "")
+	assert.ErrorIs(t, CheckValue(db, "test_retry", "-1"), ErrInvalidSetting)
+	assert.Nil(t, CheckValue(db, "test_retry", "2"))
+	retry, _ = GetSetting[int](db, "test_retry")
+	assert.Equal(t, 2, retry)
+}
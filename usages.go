@@ -0,0 +1,266 @@
+package rabbit
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DefaultUsageRecorder record the permissions passed by WithAuthorization, nil means disabled
+var DefaultUsageRecorder *UsageRecorder
+
+type usageKey struct {
+	UserID uint
+	Uri    string
+	Method string
+}
+
+type usageHit struct {
+	Hits       int64
+	LastUsedAt time.Time
+}
+
+// UsageRecorder batch the hits in memory, Flush write them to PermissionUsage and RoleUsage
+type UsageRecorder struct {
+	lock sync.Mutex
+	hits map[usageKey]*usageHit
+}
+
+func NewUsageRecorder() *UsageRecorder {
+	return &UsageRecorder{hits: map[usageKey]*usageHit{}}
+}
+
+func (r *UsageRecorder) Record(uid uint, uri, method string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := usageKey{UserID: uid, Uri: uri, Method: method}
+	hit, ok := r.hits[key]
+	if !ok {
+		hit = &usageHit{}
+		r.hits[key] = hit
+	}
+	hit.Hits++
+	hit.LastUsedAt = time.Now().UTC()
+}
+
+/*
+Flush write the recorded hits to db in a transaction, the hits are merged back if failed
+1. the hits are attributed to the roles of user which allow the permission
+2. permission usage: (permission, role)
+3. role usage: (user, role)
+*/
+func (r *UsageRecorder) Flush(db *gorm.DB) error {
+	r.lock.Lock()
+	hits := r.hits
+	r.hits = map[usageKey]*usageHit{}
+	r.lock.Unlock()
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for key, hit := range hits {
+			p, err := GetPermission(tx, key.Uri, key.Method)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				Warningf("flush permission usage: permission %s %s not found, %d hits dropped", key.Method, key.Uri, hit.Hits)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			// 1
+			var rids []uint
+			result := tx.Model(&RolePermission{}).
+				Where("permission_id", p.ID).
+				Where("deny", false).
+				Where("role_id IN (?)", userRoleIDsQuery(tx, key.UserID)).
+				Pluck("role_id", &rids)
+			if result.Error != nil {
+				return result.Error
+			}
+
+			for _, rid := range rids {
+				// 2
+				pu := PermissionUsage{PermissionID: p.ID, RoleID: rid, Hits: hit.Hits, LastUsedAt: hit.LastUsedAt}
+				if err := tx.Clauses(usageUpsert(tx, &pu, hit, "permission_id", "role_id")).Create(&pu).Error; err != nil {
+					return err
+				}
+				// 3
+				ru := RoleUsage{UserID: key.UserID, RoleID: rid, Hits: hit.Hits, LastUsedAt: hit.LastUsedAt}
+				if err := tx.Clauses(usageUpsert(tx, &ru, hit, "user_id", "role_id")).Create(&ru).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		r.merge(hits)
+	}
+	return err
+}
+
+// merge the hits not flushed back, with the hits recorded while flushing
+func (r *UsageRecorder) merge(hits map[usageKey]*usageHit) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for key, hit := range hits {
+		current, ok := r.hits[key]
+		if !ok {
+			r.hits[key] = hit
+			continue
+		}
+		current.Hits += hit.Hits
+		if hit.LastUsedAt.After(current.LastUsedAt) {
+			current.LastUsedAt = hit.LastUsedAt
+		}
+	}
+}
+
+// the hits column is qualified by table, it is ambiguous with the excluded row of postgres
+func usageUpsert(db *gorm.DB, model any, hit *usageHit, keys ...string) clause.OnConflict {
+	columns := make([]clause.Column, 0, len(keys))
+	for _, k := range keys {
+		columns = append(columns, clause.Column{Name: k})
+	}
+	hits := clause.Column{Table: tableOf(db, model).Name, Name: "hits"}
+	return clause.OnConflict{
+		Columns: columns,
+		DoUpdates: clause.Assignments(map[string]any{
+			"hits":         gorm.Expr("? + ?", hits, hit.Hits),
+			"last_used_at": hit.LastUsedAt,
+		}),
+	}
+}
+
+// StartUsageFlusher flush the recorder every interval in background, until stop is called,
+// the remaining hits are flushed when stop
+func StartUsageFlusher(db *gorm.DB, r *UsageRecorder, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer close(exited)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				if err := r.Flush(db); err != nil {
+					Warningln("flush permission usage fail:", err)
+				}
+				return
+			case <-ticker.C:
+				if err := r.Flush(db); err != nil {
+					Warningln("flush permission usage fail:", err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-exited
+		})
+	}
+}
+
+type UnusedPermission struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Uri        string     `json:"uri"`
+	Method     string     `json:"method"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+type IdleRoleGrant struct {
+	UserID     uint       `json:"userId"`
+	Email      string     `json:"email"`
+	RoleID     uint       `json:"roleId"`
+	RoleName   string     `json:"roleName"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+type UsageReport struct {
+	Days              int                 `json:"days"`
+	Since             time.Time           `json:"since"`
+	UnusedPermissions []*UnusedPermission `json:"unusedPermissions"`
+	EmptyRoles        []*Role             `json:"emptyRoles"`
+	IdleGrants        []*IdleRoleGrant    `json:"idleGrants"`
+}
+
+/*
+GetUsageReport report for access review, only the flushed hits are counted
+1. route permissions not used in days, group and named permissions are not recorded
+2. roles without unexpired members
+3. users holding roles not exercised in days
+*/
+func GetUsageReport(db *gorm.DB, days int) (*UsageReport, error) {
+	since := time.Now().UTC().AddDate(0, 0, -days)
+	report := &UsageReport{Days: days, Since: since}
+
+	// 1
+	recent := db.Model(&PermissionUsage{}).
+		Select("permission_id").
+		Where("last_used_at >= ?", since)
+	result := db.Model(&Permission{}).
+		Select("id, name, uri, method").
+		Where("method <> ?", "").
+		Where("anonymous", false).
+		Where("id NOT IN (?)", recent).
+		Order("id").
+		Find(&report.UnusedPermissions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	ids := make([]uint, 0, len(report.UnusedPermissions))
+	for _, p := range report.UnusedPermissions {
+		ids = append(ids, p.ID)
+	}
+	var usages []PermissionUsage
+	if err := db.Where("permission_id IN ?", ids).Find(&usages).Error; err != nil {
+		return nil, err
+	}
+	lastUsed := map[uint]time.Time{}
+	for _, u := range usages {
+		if u.LastUsedAt.After(lastUsed[u.PermissionID]) {
+			lastUsed[u.PermissionID] = u.LastUsedAt
+		}
+	}
+	for _, p := range report.UnusedPermissions {
+		if t, ok := lastUsed[p.ID]; ok {
+			p.LastUsedAt = &t
+		}
+	}
+
+	// 2
+	members := db.Model(&UserRole{}).
+		Select("role_id").
+		Where("expires_at IS NULL OR expires_at > ?", time.Now().UTC())
+	result = db.Where("id NOT IN (?)", members).
+		Order("id").
+		Find(&report.EmptyRoles)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	// 3
+	result = db.Table("? AS user_roles", tableOf(db, &UserRole{})).
+		Select("user_roles.user_id, users.email, user_roles.role_id, roles.name AS role_name, role_usages.last_used_at").
+		Joins("JOIN ? AS users ON users.id = user_roles.user_id", tableOf(db, &User{})).
+		Joins("JOIN ? AS roles ON roles.id = user_roles.role_id", tableOf(db, &Role{})).
+		Joins("LEFT JOIN ? AS role_usages ON role_usages.user_id = user_roles.user_id AND role_usages.role_id = user_roles.role_id", tableOf(db, &RoleUsage{})).
+		Where("user_roles.expires_at IS NULL OR user_roles.expires_at > ?", time.Now().UTC()).
+		Where("role_usages.last_used_at IS NULL OR role_usages.last_used_at < ?", since).
+		Order("user_roles.user_id, user_roles.role_id").
+		Scan(&report.IdleGrants)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return report, nil
+}
@@ -0,0 +1,141 @@
+package rabbit
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageRecorder(t *testing.T) {
+	db, r, client := initTestClient(t)
+	SetValue(db, KEY_API_NEED_AUTH, "true")
+
+	DefaultUsageRecorder = NewUsageRecorder()
+	defer func() { DefaultUsageRecorder = nil }()
+
+	ar := r.Group("/api").Use(WithAuthentication(), WithAuthorization("/api"))
+	ar.GET("/user", func(ctx *gin.Context) { ctx.JSON(http.StatusOK, true) })
+
+	err := client.CallPost("/auth/register", RegisterUserForm{Email: "bob@example.org", Password: "123456"}, nil)
+	assert.Nil(t, err)
+	bob, _ := GetUserByEmail(db, "bob@example.org")
+	alice, _ := CreateUser(db, "alice@example.org", "123456")
+
+	list, _ := SavePermission(db, 0, 0, "list user", "/user", http.MethodGet, false)
+	del, _ := SavePermission(db, 0, 0, "delete user", "/user/:key", http.MethodDelete, false)
+	viewer, _ := AddRoleWithPermissions(db, "viewer", "VIEWER", []uint{list.ID})
+	admin, _ := AddRoleWithPermissions(db, "admin", "ADMIN", []uint{del.ID})
+	empty, _ := CreateRole(db, "empty", "EMPTY")
+	AddRoleForUser(db, bob.ID, viewer.ID)
+	AddRoleForUser(db, alice.ID, admin.ID)
+
+	for i := 0; i < 3; i++ {
+		w := client.Get("/api/user")
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// not flushed
+	var count int64
+	db.Model(&PermissionUsage{}).Count(&count)
+	assert.Equal(t, int64(0), count)
+
+	err = DefaultUsageRecorder.Flush(db)
+	assert.Nil(t, err)
+
+	client.Get("/api/user")
+	err = DefaultUsageRecorder.Flush(db)
+	assert.Nil(t, err)
+
+	var pu PermissionUsage
+	err = db.Where("permission_id = ? AND role_id = ?", list.ID, viewer.ID).Take(&pu).Error
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), pu.Hits)
+
+	var ru RoleUsage
+	err = db.Where("user_id = ? AND role_id = ?", bob.ID, viewer.ID).Take(&ru).Error
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), ru.Hits)
+
+	report, err := GetUsageReport(db, 30)
+	assert.Nil(t, err)
+	assert.Len(t, report.UnusedPermissions, 1)
+	assert.Equal(t, del.ID, report.UnusedPermissions[0].ID)
+	assert.Len(t, report.EmptyRoles, 1)
+	assert.Equal(t, empty.ID, report.EmptyRoles[0].ID)
+	assert.Len(t, report.IdleGrants, 1)
+	assert.Equal(t, alice.ID, report.IdleGrants[0].UserID)
+	assert.Equal(t, "admin", report.IdleGrants[0].RoleName)
+
+	// usage older than days
+	db.Model(&PermissionUsage{}).Where("1 = 1").Update("last_used_at", time.Now().UTC().AddDate(0, 0, -60))
+	db.Model(&RoleUsage{}).Where("1 = 1").Update("last_used_at", time.Now().UTC().AddDate(0, 0, -60))
+	report, err = GetUsageReport(db, 30)
+	assert.Nil(t, err)
+	assert.Len(t, report.UnusedPermissions, 2)
+	assert.NotNil(t, report.UnusedPermissions[0].LastUsedAt)
+	assert.Len(t, report.IdleGrants, 2)
+}
+
+func TestUsageFlusher(t *testing.T) {
+	db := initDB(t)
+	u, _ := CreateUser(db, "bob@example.org", "123456")
+	p, _ := SavePermission(db, 0, 0, "list user", "/user", http.MethodGet, false)
+	role, _ := AddRoleWithPermissions(db, "viewer", "VIEWER", []uint{p.ID})
+	AddRoleForUser(db, u.ID, role.ID)
+
+	recorder := NewUsageRecorder()
+	stop := StartUsageFlusher(db, recorder, time.Hour)
+	recorder.Record(u.ID, "/user", http.MethodGet)
+	recorder.Record(u.ID, "/unknown", http.MethodGet)
+	stop()
+	stop()
+
+	var pu PermissionUsage
+	err := db.Where("permission_id = ? AND role_id = ?", p.ID, role.ID).Take(&pu).Error
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), pu.Hits)
+}
+
+func TestUsageFlushFailure(t *testing.T) {
+	db := initDB(t)
+	u, _ := CreateUser(db, "bob@example.org", "123456")
+	p, _ := SavePermission(db, 0, 0, "list user", "/user", http.MethodGet, false)
+	role, _ := AddRoleWithPermissions(db, "viewer", "VIEWER", []uint{p.ID})
+	AddRoleForUser(db, u.ID, role.ID)
+
+	recorder := NewUsageRecorder()
+	recorder.Record(u.ID, "/user", http.MethodGet)
+	recorder.Record(u.ID, "/user", http.MethodGet)
+
+	// merged back with the hits recorded after
+	restore := injectFailure(db, "role_usages")
+	err := recorder.Flush(db)
+	restore()
+	assert.NotNil(t, err)
+	recorder.Record(u.ID, "/user", http.MethodGet)
+
+	var count int64
+	db.Model(&PermissionUsage{}).Count(&count)
+	assert.Equal(t, int64(0), count)
+
+	err = recorder.Flush(db)
+	assert.Nil(t, err)
+	recorder.Record(u.ID, "/user", http.MethodGet)
+	err = recorder.Flush(db)
+	assert.Nil(t, err)
+
+	var pu PermissionUsage
+	err = db.Where("permission_id = ? AND role_id = ?", p.ID, role.ID).Take(&pu).Error
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), pu.Hits)
+
+	// the role with only expired members is empty
+	db.Model(&UserRole{}).Where("user_id", u.ID).Update("expires_at", time.Now().UTC().Add(-time.Hour))
+	report, err := GetUsageReport(db, 30)
+	assert.Nil(t, err)
+	assert.Len(t, report.EmptyRoles, 1)
+	assert.Equal(t, role.ID, report.EmptyRoles[0].ID)
+}
@@ -9,7 +9,7 @@ import (
 )
 
 func TestUserProfile(t *testing.T) {
-	db := InitDatabase("", "", nil)
+	db := newTestDB(t)
 	MakeMigrates(db, &User{})
 
 	bob, _ := CreateUser(db, "bob@example.org", "123456")
@@ -25,7 +25,7 @@ func TestUserProfile(t *testing.T) {
 }
 
 func TestUserHashToken(t *testing.T) {
-	db := InitDatabase("", "", nil)
+	db := newTestDB(t)
 	MakeMigrates(db, &User{}, &Config{})
 
 	bob, _ := CreateUser(db, "bob@example.org", "123456")